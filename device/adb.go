@@ -0,0 +1,142 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultADBServerAddress = "127.0.0.1:5037"
+
+// Minimal client for the adb server host protocol
+// https://android.googlesource.com/platform/packages/modules/adb/+/refs/heads/main/docs/dev/protocol.md
+type adbClient struct {
+	address string
+}
+
+func newADBClient() *adbClient {
+	address := Config.EnvConfig.ADBServer
+	if address == "" {
+		address = defaultADBServerAddress
+	}
+	return &adbClient{address: address}
+}
+
+// Get the serials of the Android devices attached to the adb server that are online
+func (client *adbClient) listDevices() ([]string, error) {
+	conn, err := client.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = adbSendRequest(conn, "host:devices")
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := adbReadLengthPrefixed(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var serials []string
+	for _, line := range strings.Split(payload, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "device" {
+			continue
+		}
+		serials = append(serials, fields[0])
+	}
+
+	return serials, nil
+}
+
+// Run a shell command on a device and return its output
+func (client *adbClient) shell(serial string, command string) (string, error) {
+	conn, err := client.connect()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	err = adbSendRequest(conn, "host:transport:"+serial)
+	if err != nil {
+		return "", err
+	}
+
+	err = adbSendRequest(conn, "shell:"+command)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (client *adbClient) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", client.address, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn, nil
+}
+
+// Send a length prefixed request to the adb server and check its status
+func adbSendRequest(conn net.Conn, request string) error {
+	_, err := fmt.Fprintf(conn, "%04x%s", len(request), request)
+	if err != nil {
+		return err
+	}
+
+	status := make([]byte, 4)
+	_, err = io.ReadFull(conn, status)
+	if err != nil {
+		return err
+	}
+
+	switch string(status) {
+	case "OKAY":
+		return nil
+	case "FAIL":
+		message, err := adbReadLengthPrefixed(conn)
+		if err != nil {
+			return err
+		}
+		return errors.New("adb request `" + request + "` failed: " + message)
+	default:
+		return errors.New("unexpected adb response status: " + string(status))
+	}
+}
+
+// Read a payload prefixed with its hex encoded length
+func adbReadLengthPrefixed(conn net.Conn) (string, error) {
+	lengthHex := make([]byte, 4)
+	_, err := io.ReadFull(conn, lengthHex)
+	if err != nil {
+		return "", err
+	}
+
+	length, err := strconv.ParseUint(string(lengthHex), 16, 32)
+	if err != nil {
+		return "", err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		return "", err
+	}
+
+	return string(payload), nil
+}
@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,7 +13,12 @@ import (
 type ConfigJsonData struct {
 	AppiumConfig AppiumConfig `json:"appium-config"`
 	EnvConfig    EnvConfig    `json:"env-config"`
-	Devices      []*Device    `json:"devices-config"`
+	NativeConfig NativeConfig `json:"native-config,omitempty"`
+	// Container overrides for all devices of an OS
+	ContainerConfig ContainerConfig `json:"container-config,omitempty"`
+	// Commands allowed through the device exec endpoint
+	ExecConfig ExecConfig `json:"exec-config,omitempty"`
+	Devices    []*Device  `json:"devices-config"`
 }
 
 type AppiumConfig struct {
@@ -28,6 +33,38 @@ type EnvConfig struct {
 	SupervisionPassword string `json:"supervision_password"`
 	WDABundleID         string `json:"wda_bundle_id"`
 	RethinkDB           string `json:"rethink_db"`
+	DeviceDiscovery     string `json:"device_discovery,omitempty"`
+	ADBServer           string `json:"adb_server,omitempty"`
+	UsbmuxdSocket       string `json:"usbmuxd_socket,omitempty"`
+	DeviceStore         string `json:"device_store,omitempty"`
+	DeviceStorePath     string `json:"device_store_path,omitempty"`
+	ContainerRuntime    string `json:"container_runtime,omitempty"`
+	// `container` or `native`, can be overridden per device
+	RunMode string `json:"run_mode,omitempty"`
+	// Container failures in the failure window after which the device is quarantined
+	MaxContainerFailures      int `json:"max_container_failures,omitempty"`
+	ContainerFailureWindowSec int `json:"container_failure_window_sec,omitempty"`
+	// Docker Engine API compatible socket, e.g. `unix:///run/user/1000/podman/podman.sock`
+	ContainerRuntimeSocket string `json:"container_runtime_socket,omitempty"`
+	// Minimum interval between two DB writes of the same device
+	MinDBWriteIntervalMs int `json:"min_db_write_interval_ms,omitempty"`
+	// Minimum interval between two DB writes of only the last healthy timestamp of a device
+	HealthyTimestampIntervalMs int `json:"healthy_timestamp_interval_ms,omitempty"`
+	// How often orphan device containers are collected
+	OrphanGCIntervalSec int `json:"orphan_gc_interval_sec,omitempty"`
+	// How long a device can be disconnected before its container is collected
+	OrphanGCGraceSec int `json:"orphan_gc_grace_sec,omitempty"`
+	// Stop the device containers on shutdown instead of leaving them running for a fast restart
+	StopContainersOnShutdown bool `json:"stop_containers_on_shutdown,omitempty"`
+	// How long in-flight requests are drained on shutdown
+	ShutdownTimeoutSec int `json:"shutdown_timeout_sec,omitempty"`
+	// Consecutive failed health checks before a device is marked unhealthy
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"`
+	// Consecutive successful health checks before an unhealthy device is marked healthy
+	HealthyThreshold int `json:"healthy_threshold,omitempty"`
+	// Health state changes within the flap window after which a device is flagged as flapping
+	FlapThreshold int `json:"flap_threshold,omitempty"`
+	FlapWindowSec int `json:"flap_window_sec,omitempty"`
 }
 
 type Device struct {
@@ -35,11 +72,13 @@ type Device struct {
 	Connected            bool             `json:"connected,omitempty"`
 	Healthy              bool             `json:"healthy,omitempty"`
 	LastHealthyTimestamp int64            `json:"last_healthy_timestamp,omitempty"`
+	Health               *HealthReport    `json:"health,omitempty"`
+	HealthState          *HealthState     `json:"health_state,omitempty"`
 	UDID                 string           `json:"udid"`
 	OS                   string           `json:"os"`
-	AppiumPort           string           `json:"appium_port"`
-	StreamPort           string           `json:"stream_port"`
-	ContainerServerPort  string           `json:"container_server_port"`
+	AppiumPort           string           `json:"appium_port,omitempty"`
+	StreamPort           string           `json:"stream_port,omitempty"`
+	ContainerServerPort  string           `json:"container_server_port,omitempty"`
 	WDAPort              string           `json:"wda_port,omitempty"`
 	Name                 string           `json:"name"`
 	OSVersion            string           `json:"os_version"`
@@ -49,6 +88,22 @@ type Device struct {
 	Host                 string           `json:"host"`
 	AppiumSessionID      string           `json:"appiumSessionID,omitempty"`
 	WDASessionID         string           `json:"wdaSessionID,omitempty"`
+	Discovered           bool             `json:"discovered,omitempty"`
+	Quarantine           *QuarantineInfo  `json:"quarantine,omitempty"`
+	RunMode              string           `json:"run_mode,omitempty"`
+	// Container overrides for this device, applied on top of the OS container overrides
+	ContainerConfig *ContainerOverrides `json:"container_config,omitempty"`
+	// Ports explicitly provided for the device in config.json
+	pinnedPorts DevicePorts
+	// When the device was last seen disconnected, zero while it is connected
+	disconnectedAt time.Time
+	// Image kept by the device until an image rollout updates it
+	rolloutImage string
+	// Health check counters
+	healthCheckRunning bool
+	healthFailures     int
+	healthSuccesses    int
+	healthTransitions  []time.Time
 }
 
 type DeviceContainer struct {
@@ -58,6 +113,8 @@ type DeviceContainer struct {
 	ContainerName   string `json:"container_name"`
 }
 
+const configFilePath = "./configs/config.json"
+
 var projectDir string
 var Config ConfigJsonData
 
@@ -78,8 +135,18 @@ func SetupConfig() error {
 		return err
 	}
 
+	// Create the container runtime client
+	containerRuntime, err = newContainerRuntime()
+	if err != nil {
+		return err
+	}
+	nativeRuntimeInstance = newNativeRuntime()
+
 	// Create a connection to the DB
-	newDBConn()
+	err = newDBConn()
+	if err != nil {
+		return err
+	}
 
 	// Initialize the devices from config.json and update them in the DB
 	err = updateDevicesFromConfig()
@@ -102,7 +169,7 @@ func updateDevicesFromConfig() error {
 	}
 
 	// Loop through the devices from the config
-	for index, device := range Config.Devices {
+	for _, device := range Config.Devices {
 		// Update each device Connected field
 		device.Connected = false
 		for _, connectedDevice := range connectedDevices {
@@ -110,18 +177,18 @@ func updateDevicesFromConfig() error {
 				device.Connected = true
 			}
 		}
+		device.trackDisconnect(time.Now())
 
 		// Update the other fields
-		wdaPort := ""
-		if device.OS == "ios" {
-			wdaPort = strconv.Itoa(20001 + index)
-		}
 		device.Container = nil
-		device.AppiumPort = strconv.Itoa(4841 + index)
-		device.StreamPort = strconv.Itoa(20101 + index)
-		device.ContainerServerPort = strconv.Itoa(20201 + index)
-		device.WDAPort = wdaPort
 		device.Host = Config.EnvConfig.DevicesHost
+		err = device.allocatePorts()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "port_allocation",
+			}).Error("Could not allocate ports for device " + device.UDID + ": " + err.Error())
+			return err
+		}
 	}
 
 	// Insert the devices to the DB if they are not already inserted
@@ -136,16 +203,100 @@ func updateDevicesFromConfig() error {
 
 // Read the config.json file and initialize the configuration struct
 func getConfigJsonData() error {
-	bs, err := getConfigJsonBytes()
+	configData, err := readConfigJsonData()
 	if err != nil {
 		return err
 	}
+	Config = configData
 
-	err = json.Unmarshal(bs, &Config)
+	return nil
+}
+
+// Read the config.json file into a new configuration struct
+// without touching the currently applied configuration
+func readConfigJsonData() (ConfigJsonData, error) {
+	var configData ConfigJsonData
+
+	bs, err := getConfigJsonBytes()
+	if err != nil {
+		return configData, err
+	}
+
+	err = json.Unmarshal(bs, &configData)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "get_config_data",
 		}).Error("Could not unmarshal config file: " + err.Error())
+		return configData, err
+	}
+
+	problems := validateConfig(configData)
+	if len(problems) > 0 {
+		validationErr := &ConfigValidationError{Problems: problems}
+		log.WithFields(log.Fields{
+			"event": "get_config_data",
+		}).Error("Invalid config file: " + validationErr.Error())
+		return configData, validationErr
+	}
+
+	// Ports provided in config.json are pinned and should not be allocated automatically
+	for _, device := range configData.Devices {
+		device.pinnedPorts = device.ports()
+	}
+
+	return configData, nil
+}
+
+// Get a copy of the device with only the fields that are provided through config.json
+func (device *Device) configEntry() *Device {
+	return &Device{
+		UDID:                device.UDID,
+		OS:                  device.OS,
+		Name:                device.Name,
+		OSVersion:           device.OSVersion,
+		ScreenSize:          device.ScreenSize,
+		Model:               device.Model,
+		Image:               device.Image,
+		RunMode:             device.RunMode,
+		ContainerConfig:     device.ContainerConfig,
+		AppiumPort:          device.pinnedPorts.AppiumPort,
+		StreamPort:          device.pinnedPorts.StreamPort,
+		ContainerServerPort: device.pinnedPorts.ContainerServerPort,
+		WDAPort:             device.pinnedPorts.WDAPort,
+	}
+}
+
+// Write the current configuration back to config.json atomically
+func saveConfigJsonData() error {
+	return saveConfigDevices(Config.Devices)
+}
+
+// Write the current configuration with the provided devices back to config.json atomically
+func saveConfigDevices(devices []*Device) error {
+	configData := ConfigJsonData{
+		AppiumConfig:    Config.AppiumConfig,
+		EnvConfig:       Config.EnvConfig,
+		NativeConfig:    Config.NativeConfig,
+		ContainerConfig: Config.ContainerConfig,
+		ExecConfig:      Config.ExecConfig,
+	}
+	for _, device := range devices {
+		configData.Devices = append(configData.Devices, device.configEntry())
+	}
+
+	bs, err := json.MarshalIndent(configData, "", "  ")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "save_config_data",
+		}).Error("Could not marshal config data: " + err.Error())
+		return err
+	}
+
+	err = writeFileAtomic(configFilePath, bs)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "save_config_data",
+		}).Error("Could not write config file: " + err.Error())
 		return err
 	}
 
@@ -154,7 +305,7 @@ func getConfigJsonData() error {
 
 // Read the config.json file into a byte slice
 func getConfigJsonBytes() ([]byte, error) {
-	jsonFile, err := os.Open("./configs/config.json")
+	jsonFile, err := os.Open(configFilePath)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "get_config_data",
@@ -0,0 +1,139 @@
+package device
+
+import (
+	"sort"
+	"strings"
+)
+
+// Overrides merged on top of the default device container definition
+type ContainerOverrides struct {
+	// Full image name, e.g. `android-appium:beta`
+	Image string `json:"image,omitempty"`
+	// Extra environment variables, replace the default variables with the same name
+	Env map[string]string `json:"env,omitempty"`
+	// Extra bind mounts, replace the default mounts with the same target
+	Mounts []ContainerMount `json:"mounts,omitempty"`
+	// CPU limit in number of CPUs, e.g. `1.5`
+	CPUs float64 `json:"cpus,omitempty"`
+	// Memory limit in megabytes
+	MemoryMB int64 `json:"memory_mb,omitempty"`
+	// `bridge`, `host`, `none` or the name of a user defined network
+	NetworkMode string `json:"network_mode,omitempty"`
+}
+
+type ContainerMount struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// Deep copy of the overrides so a copy of a device does not share the env map and mounts with it
+func (overrides *ContainerOverrides) clone() *ContainerOverrides {
+	if overrides == nil {
+		return nil
+	}
+
+	overridesCopy := *overrides
+	if overrides.Env != nil {
+		overridesCopy.Env = make(map[string]string, len(overrides.Env))
+		for key, value := range overrides.Env {
+			overridesCopy.Env[key] = value
+		}
+	}
+	if overrides.Mounts != nil {
+		overridesCopy.Mounts = append([]ContainerMount{}, overrides.Mounts...)
+	}
+	return &overridesCopy
+}
+
+// Container overrides for all devices of an OS, the device overrides are applied on top of them
+type ContainerConfig struct {
+	Android ContainerOverrides `json:"android,omitempty"`
+	IOS     ContainerOverrides `json:"ios,omitempty"`
+}
+
+func (config ContainerConfig) forOS(deviceOS string) ContainerOverrides {
+	switch deviceOS {
+	case "android":
+		return config.Android
+	case "ios":
+		return config.IOS
+	}
+	return ContainerOverrides{}
+}
+
+// Merge the OS overrides and then the device overrides on top of the default container spec
+// The `image` field of the device is its picture, the container image is only taken from `container_config`
+func (device *Device) applyContainerOverrides(spec ContainerSpec) ContainerSpec {
+	spec = Config.ContainerConfig.forOS(device.OS).apply(spec)
+	// Devices that were not updated yet by a running image rollout keep the previous image
+	if device.rolloutImage != "" {
+		spec.Image = device.rolloutImage
+	}
+	if device.ContainerConfig != nil {
+		spec = device.ContainerConfig.apply(spec)
+	}
+	return spec
+}
+
+func (overrides ContainerOverrides) apply(spec ContainerSpec) ContainerSpec {
+	if overrides.Image != "" {
+		spec.Image = overrides.Image
+	}
+	spec.Env = mergeEnv(spec.Env, overrides.Env)
+	for _, containerMount := range overrides.Mounts {
+		spec.Mounts = mergeMount(spec.Mounts, MountSpec{
+			Source:   containerMount.Source,
+			Target:   containerMount.Target,
+			ReadOnly: containerMount.ReadOnly,
+		})
+	}
+	if overrides.CPUs > 0 {
+		spec.CPUs = overrides.CPUs
+	}
+	if overrides.MemoryMB > 0 {
+		spec.MemoryMB = overrides.MemoryMB
+	}
+	if overrides.NetworkMode != "" {
+		spec.NetworkMode = overrides.NetworkMode
+	}
+	return spec
+}
+
+// Set the variables on top of a `KEY=value` list, the new variables are added sorted by name
+func mergeEnv(env []string, variables map[string]string) []string {
+	merged := append([]string{}, env...)
+
+	var names []string
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		variable := name + "=" + variables[name]
+		replaced := false
+		for i, existing := range merged {
+			if strings.HasPrefix(existing, name+"=") {
+				merged[i] = variable
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, variable)
+		}
+	}
+	return merged
+}
+
+// Add the mount replacing a mount with the same target
+func mergeMount(mounts []MountSpec, newMount MountSpec) []MountSpec {
+	merged := append([]MountSpec{}, mounts...)
+	for i, existing := range merged {
+		if existing.Target == newMount.Target {
+			merged[i] = newMount
+			return merged
+		}
+	}
+	return append(merged, newMount)
+}
@@ -4,61 +4,38 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
 )
 
-var session *r.Session
-
-// Create a new connection to the DB
-func newDBConn() {
-	var err error = nil
-	session, err = r.Connect(r.ConnectOpts{
-		Address:  Config.EnvConfig.RethinkDB,
-		Database: "gads",
-	})
-
+// Create the device store selected in env-config
+func newDBConn() error {
+	var err error
+	store, err = newDeviceStore()
 	if err != nil {
-		panic("Could not make initial connection to RethinkDB on " + Config.EnvConfig.RethinkDB + ", make sure it is set up and running: " + err.Error())
+		log.WithFields(log.Fields{
+			"event": "db_connect",
+		}).Error("Could not create device store: " + err.Error())
+		return err
 	}
 
-	go checkDBConnection()
-}
+	// Start writing the devices changes that were delayed by the minimum write interval
+	go writer.flushLoop()
 
-// Check if the DB connection is alive and attempt to reconnect if not
-func checkDBConnection() {
-	for {
-		if !session.IsConnected() {
-			err := session.Reconnect()
-			if err != nil {
-				panic("DB is not connected and could not reestablish connection: " + err.Error())
-			}
-		}
-		time.Sleep(2 * time.Second)
-	}
+	return nil
 }
 
 // Insert/update the registered devices from config.json to the DB
 // when starting the provider
 func insertDevicesDB() error {
 	for _, device := range Config.Devices {
-		// Check if data for the device by UDID already exists in the table
-		cursor, err := r.Table("devices").Get(device.UDID).Run(session)
-		if err != nil {
-			return err
-		}
+		// Check if data for the device by UDID already exists in the store
+		_, err := store.Get(device.UDID)
 
-		// If there is no data for the device with this UDID
-		// Insert the data into the table
-		if cursor.IsNil() {
-			err = r.Table("devices").Insert(device).Exec(session)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"event": "insert_db",
-				}).Error("Inserting device in DB failed: " + err.Error())
-			}
+		// If there is no data for the device with this UDID or the store is not reachable yet
+		// Insert the data into the store, existing documents are updated on insert
+		if err != nil {
+			device.insertDB()
 			continue
 		}
-		cursor.Close()
 
 		// If data for the device with this UDID exists in the DB
 		// Update it with the latest info
@@ -68,49 +45,63 @@ func insertDevicesDB() error {
 	return nil
 }
 
-// Update the respective device document in the DB
-func (device *Device) updateDB() {
-	err := r.Table("devices").Update(device).Exec(session)
+// Insert a new device document in the DB
+func (device *Device) insertDB() {
+	err := store.Insert(device)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"event": "update_db",
-		}).Error("Updating device in DB failed: " + err.Error())
+			"event": "insert_db",
+		}).Error("Inserting device in DB failed: " + err.Error())
+		return
 	}
+	writer.written(device)
+}
+
+// Delete the device document from the DB
+func (device *Device) deleteDB() {
+	err := store.Delete(device.UDID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "delete_db",
+		}).Error("Deleting device " + device.UDID + " from DB failed: " + err.Error())
+	}
+	writer.forget(device.UDID)
+}
+
+// Update the changed fields of the respective device document in the DB
+// Unchanged devices are not written and writes are rate limited per device
+func (device *Device) updateDB() {
+	writer.markDirty(device)
 }
 
 // Loop through the registered devices and update the health status in the DB for each device each second
 func devicesHealthCheck() {
-	for {
+	for !shuttingDown() {
+		configMu.Lock()
 		for _, device := range Config.Devices {
-			if device.Connected == true {
-				go device.updateHealthStatusDB()
+			// Skip the device if its previous check is still running so the results are applied in order
+			if device.Connected && !device.healthCheckRunning {
+				device.healthCheckRunning = true
+				go device.updateHealthStatusDB(device.clone())
 			}
 		}
+		configMu.Unlock()
 		time.Sleep(1 * time.Second)
 	}
 }
 
-// Check Appium and WDA(for iOS) status and update the device health in DB
-func (device *Device) updateHealthStatusDB() {
-	allGood := false
-	appiumGood := false
-	wdaGood := true
+// Check the device components on a copy of the device so the checks run without configMu
+// and update the device health in DB
+func (device *Device) updateHealthStatusDB(snapshot *Device) {
+	report := snapshot.healthReport(false)
 
-	appiumGood, _ = device.appiumHealthy()
+	configMu.Lock()
+	defer configMu.Unlock()
 
-	if appiumGood && device.OS == "ios" {
-		wdaGood, _ = device.wdaHealthy()
-	}
-
-	allGood = appiumGood && wdaGood
-
-	if allGood {
-		device.LastHealthyTimestamp = time.Now().UnixMilli()
-		device.Healthy = true
-		device.updateDB()
-
-	} else {
-		device.Healthy = false
-		device.updateDB()
+	device.healthCheckRunning = false
+	// The devices are already marked offline or the device was unregistered meanwhile
+	if shuttingDown() || getDeviceByUDID(device.UDID) != device {
+		return
 	}
+	device.applyHealthReport(report)
 }
@@ -0,0 +1,249 @@
+package device
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMinDBWriteInterval       = 1 * time.Second
+	defaultHealthyTimestampInterval = 30 * time.Second
+)
+
+// Device fields updated by every health check
+var healthCheckFields = []string{"last_healthy_timestamp", "health"}
+
+// The last state of a device document written to the store
+type writtenDevice struct {
+	// Serializes writes of the same device so they reach the store in order
+	writeMu sync.Mutex
+
+	// Copy of the device taken when it was marked dirty, the live device is changed under configMu while it is written
+	device           *Device
+	document         map[string]interface{}
+	dirty            bool
+	lastWrite        time.Time
+	lastHealthyWrite time.Time
+}
+
+// Tracks the changed fields of each device and writes only them to the store
+// Writes of the same device are rate limited and the last healthy timestamp is written at a coarser cadence
+type deviceWriter struct {
+	mu      sync.Mutex
+	devices map[string]*writtenDevice
+	// Set on shutdown, later changes are not written
+	closed bool
+}
+
+var writer = &deviceWriter{devices: make(map[string]*writtenDevice)}
+
+// Get the minimum interval between two writes of the same device
+func minDBWriteInterval() time.Duration {
+	if Config.EnvConfig.MinDBWriteIntervalMs > 0 {
+		return time.Duration(Config.EnvConfig.MinDBWriteIntervalMs) * time.Millisecond
+	}
+	return defaultMinDBWriteInterval
+}
+
+// Get the minimum interval between two writes of the device last healthy timestamp alone
+func healthyTimestampInterval() time.Duration {
+	if Config.EnvConfig.HealthyTimestampIntervalMs > 0 {
+		return time.Duration(Config.EnvConfig.HealthyTimestampIntervalMs) * time.Millisecond
+	}
+	return defaultHealthyTimestampInterval
+}
+
+// Mark the device as changed and write it right away if the minimum write interval has passed
+// Otherwise the changes are written on the next flush
+// Should be called with configMu held
+func (w *deviceWriter) markDirty(device *Device) {
+	snapshot := device.clone()
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	written, ok := w.devices[device.UDID]
+	if !ok {
+		written = &writtenDevice{}
+		w.devices[device.UDID] = written
+	}
+	written.device = snapshot
+	written.dirty = true
+	due := time.Since(written.lastWrite) >= minDBWriteInterval()
+	w.mu.Unlock()
+
+	if due {
+		w.flush(device.UDID)
+	}
+}
+
+// Remember a fully written device document so following updates only write the changes
+// Should be called with configMu held
+func (w *deviceWriter) written(device *Device) {
+	document, err := deviceDocument(device)
+	if err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	w.devices[device.UDID] = &writtenDevice{
+		device:           device.clone(),
+		document:         document,
+		lastWrite:        now,
+		lastHealthyWrite: now,
+	}
+}
+
+// Forget the written state of a device that is no longer in the store
+func (w *deviceWriter) forget(udid string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.devices, udid)
+}
+
+// Write the changed fields of a device to the store
+func (w *deviceWriter) flush(udid string) {
+	w.mu.Lock()
+	written, ok := w.devices[udid]
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	written.writeMu.Lock()
+	defer written.writeMu.Unlock()
+
+	w.mu.Lock()
+	if !written.dirty || written.device == nil {
+		w.mu.Unlock()
+		return
+	}
+	written.dirty = false
+
+	document, err := deviceDocument(written.device)
+	if err != nil {
+		w.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	changes := changedFields(written.document, document)
+
+	// Write the healthy timestamp and health report alone only at a coarser cadence since they change on every health check
+	// They are still written together with any other change
+	healthChanges := 0
+	for _, field := range healthCheckFields {
+		if _, ok := changes[field]; ok {
+			healthChanges++
+		}
+	}
+	if healthChanges > 0 {
+		if len(changes) == healthChanges && now.Sub(written.lastHealthyWrite) < healthyTimestampInterval() {
+			for _, field := range healthCheckFields {
+				delete(changes, field)
+			}
+			// Keep the device dirty so the health gets written once the interval passes
+			written.dirty = true
+		} else {
+			written.lastHealthyWrite = now
+		}
+	}
+
+	if len(changes) == 0 {
+		w.mu.Unlock()
+		return
+	}
+
+	if written.document == nil {
+		written.document = make(map[string]interface{})
+	}
+	for key, value := range changes {
+		written.document[key] = value
+	}
+	written.lastWrite = now
+	w.mu.Unlock()
+
+	err = store.Update(udid, changes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "update_db",
+		}).Error("Updating device " + udid + " in DB failed: " + err.Error())
+	}
+}
+
+// Periodically write the devices that changed while they were rate limited
+func (w *deviceWriter) flushLoop() {
+	for {
+		time.Sleep(minDBWriteInterval())
+
+		w.mu.Lock()
+		var dirtyDevices []string
+		for udid, written := range w.devices {
+			if written.dirty && time.Since(written.lastWrite) >= minDBWriteInterval() {
+				dirtyDevices = append(dirtyDevices, udid)
+			}
+		}
+		w.mu.Unlock()
+
+		for _, udid := range dirtyDevices {
+			w.flush(udid)
+		}
+	}
+}
+
+// Write all changed devices regardless of the minimum write interval and ignore any later changes
+func (w *deviceWriter) close() {
+	w.mu.Lock()
+	var dirtyDevices []string
+	for udid, written := range w.devices {
+		if written.dirty {
+			dirtyDevices = append(dirtyDevices, udid)
+		}
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	for _, udid := range dirtyDevices {
+		w.flush(udid)
+	}
+}
+
+// Get the fields that differ between the old and new document
+// Fields missing from the new document are reset to their zero value
+func changedFields(oldDocument map[string]interface{}, newDocument map[string]interface{}) map[string]interface{} {
+	changes := make(map[string]interface{})
+
+	for key, value := range newDocument {
+		oldValue, ok := oldDocument[key]
+		if !ok || !reflect.DeepEqual(oldValue, value) {
+			changes[key] = value
+		}
+	}
+
+	for key, oldValue := range oldDocument {
+		if _, ok := newDocument[key]; ok {
+			continue
+		}
+		switch oldValue.(type) {
+		case bool:
+			changes[key] = false
+		case string:
+			changes[key] = ""
+		case float64:
+			changes[key] = 0
+		default:
+			changes[key] = nil
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,195 @@
+package device
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Memory store that records the fields of every update
+type recordingStore struct {
+	*memoryStore
+
+	mu      sync.Mutex
+	updates []map[string]interface{}
+}
+
+func (s *recordingStore) Update(udid string, fields map[string]interface{}) error {
+	s.mu.Lock()
+	s.updates = append(s.updates, fields)
+	s.mu.Unlock()
+	return s.memoryStore.Update(udid, fields)
+}
+
+func (s *recordingStore) updatedFields() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var updated [][]string
+	for _, fields := range s.updates {
+		var keys []string
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		updated = append(updated, keys)
+	}
+	return updated
+}
+
+func TestChangedFields(t *testing.T) {
+	tests := []struct {
+		name        string
+		oldDocument map[string]interface{}
+		newDocument map[string]interface{}
+		expected    map[string]interface{}
+	}{
+		{
+			name:        "unchanged",
+			oldDocument: map[string]interface{}{"udid": "udid1", "connected": true},
+			newDocument: map[string]interface{}{"udid": "udid1", "connected": true},
+			expected:    map[string]interface{}{},
+		},
+		{
+			name:        "changed and added fields",
+			oldDocument: map[string]interface{}{"udid": "udid1", "connected": true},
+			newDocument: map[string]interface{}{"udid": "udid1", "connected": false, "name": "Pixel"},
+			expected:    map[string]interface{}{"connected": false, "name": "Pixel"},
+		},
+		{
+			name: "missing fields are reset",
+			oldDocument: map[string]interface{}{
+				"udid":                   "udid1",
+				"connected":              true,
+				"model":                  "Pixel",
+				"last_healthy_timestamp": float64(1000),
+				"health":                 map[string]interface{}{"healthy": true},
+			},
+			newDocument: map[string]interface{}{"udid": "udid1"},
+			expected: map[string]interface{}{
+				"connected":              false,
+				"model":                  "",
+				"last_healthy_timestamp": 0,
+				"health":                 nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := changedFields(test.oldDocument, test.newDocument)
+			if !reflect.DeepEqual(changes, test.expected) {
+				t.Errorf("expected changes %v, got %v", test.expected, changes)
+			}
+		})
+	}
+}
+
+func TestDeviceWriterThrottlesHealthFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(device *Device)
+		// The fields written by each update after the change
+		expected [][]string
+		dirty    bool
+	}{
+		{
+			name:     "unchanged device",
+			change:   func(device *Device) {},
+			expected: nil,
+			dirty:    false,
+		},
+		{
+			name: "health only change is deferred",
+			change: func(device *Device) {
+				device.LastHealthyTimestamp = time.Now().UnixMilli()
+				device.Health = &HealthReport{Healthy: true}
+			},
+			expected: nil,
+			dirty:    true,
+		},
+		{
+			name: "mixed change is written right away",
+			change: func(device *Device) {
+				device.LastHealthyTimestamp = time.Now().UnixMilli()
+				device.Connected = false
+			},
+			expected: [][]string{{"connected", "last_healthy_timestamp"}},
+			dirty:    false,
+		},
+		{
+			name: "other change is written right away",
+			change: func(device *Device) {
+				device.Connected = false
+			},
+			expected: [][]string{{"connected"}},
+			dirty:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := newTestDevice("udid1", true)
+			setupFakeProvider(t)
+			recording := &recordingStore{memoryStore: newMemoryStore()}
+			store = recording
+
+			configMu.Lock()
+			device.insertDB()
+			// Let the minimum write interval pass
+			writer.mu.Lock()
+			writer.devices[device.UDID].lastWrite = time.Now().Add(-time.Minute)
+			writer.mu.Unlock()
+
+			test.change(device)
+			device.updateDB()
+			configMu.Unlock()
+
+			if updated := recording.updatedFields(); !reflect.DeepEqual(updated, test.expected) {
+				t.Errorf("expected updates of %v, got %v", test.expected, updated)
+			}
+			writer.mu.Lock()
+			dirty := writer.devices[device.UDID].dirty
+			writer.mu.Unlock()
+			if dirty != test.dirty {
+				t.Errorf("expected the device to be dirty %v, got %v", test.dirty, dirty)
+			}
+		})
+	}
+}
+
+func TestDeviceWriterWritesHealthFieldsAfterInterval(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	setupFakeProvider(t)
+	recording := &recordingStore{memoryStore: newMemoryStore()}
+	store = recording
+
+	configMu.Lock()
+	device.insertDB()
+	device.LastHealthyTimestamp = time.Now().UnixMilli()
+	device.updateDB()
+	configMu.Unlock()
+	if updated := recording.updatedFields(); len(updated) != 0 {
+		t.Fatalf("expected the health change to be deferred, got updates of %v", updated)
+	}
+
+	// Once the healthy timestamp interval passed the deferred health fields are written alone
+	writer.mu.Lock()
+	writer.devices[device.UDID].lastHealthyWrite = time.Now().Add(-time.Hour)
+	writer.mu.Unlock()
+	writer.flush(device.UDID)
+
+	expected := [][]string{{"last_healthy_timestamp"}}
+	if updated := recording.updatedFields(); !reflect.DeepEqual(updated, expected) {
+		t.Errorf("expected updates of %v, got %v", expected, updated)
+	}
+	stored, err := store.Get(device.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastHealthyTimestamp != device.LastHealthyTimestamp {
+		t.Errorf("expected the stored healthy timestamp %d, got %d", device.LastHealthyTimestamp, stored.LastHealthyTimestamp)
+	}
+}
@@ -3,6 +3,8 @@ package device
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
@@ -10,16 +12,36 @@ import (
 
 func UpdateDevices() {
 	fmt.Println("Initial device update")
+	configMu.Lock()
 	updateDevicesConnectedStatus()
+	adoptContainers()
 	updateDevices()
+	configMu.Unlock()
 
 	fmt.Println("Starting devices healthcheck")
 	go devicesHealthCheck()
 
 	fmt.Println("Starting /dev watcher")
 	go devicesWatcher()
+
+	fmt.Println("Starting config.json watcher")
+	go configWatcher()
+
+	go devicesDiscovery()
+
+	fmt.Println("Starting orphan containers GC")
+	go orphanContainersGC()
+
+	fmt.Println("Starting container stats collection")
+	go collectContainerStats()
+
+	fmt.Println("Starting container runtime events watcher")
+	watchRuntimeEvents()
 }
 
+// Guards Config.Devices against concurrent device updates and config reloads
+var configMu sync.Mutex
+
 // Update the Connected status of the devices both locally and in DB each second
 func updateDevicesConnectedStatus() {
 	connectedDevices, err := getConnectedDevices()
@@ -31,12 +53,21 @@ func updateDevicesConnectedStatus() {
 	}
 
 	for _, device := range Config.Devices {
+		wasConnected := device.Connected
 		device.Connected = false
 		for _, connectedDevice := range connectedDevices {
 			if strings.Contains(connectedDevice, device.UDID) {
 				device.Connected = true
 			}
 		}
+		device.trackDisconnect(time.Now())
+
+		if device.Connected && !wasConnected {
+			device.recordEvent(EventConnected, "")
+		}
+		if !device.Connected && wasConnected {
+			device.recordEvent(EventDisconnected, "")
+		}
 		device.updateDB()
 	}
 }
@@ -53,65 +84,34 @@ func updateDevices() {
 
 	// Loop through the devices registered from the config
 	for _, device := range Config.Devices {
+		device.updateContainer(allContainers)
+	}
+}
 
-		if device.Connected {
-			device.updateDB()
-
-			// Check if the device has an already created container
-			// Also append the container data to the device struct if it does
-			hasContainer, err := device.hasContainer(allContainers)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"event": "device_update",
-				}).Error("Could not check if device " + device.UDID + " has a container: " + err.Error())
-				continue
-			}
-
-			// If the device has container
-			if hasContainer {
-				// If the container is not Up
-				if !strings.Contains(device.Container.ContainerStatus, "Up") {
-					// Restart the container
-					go device.restartContainer()
-					continue
-				}
-
-				continue
-			}
-
-			if device.OS == "ios" {
-				go device.createIOSContainer()
-				continue
-			}
-
-			if device.OS == "android" {
-				go device.createAndroidContainer()
-				continue
-			}
-			continue
-		}
+// Create, restart or remove the device container based on the device connected state
+func (device *Device) updateContainer(allContainers []ContainerInfo) {
+	device.updateDB()
 
-		// If the device is not connected
-		if !device.Connected {
-			device.updateDB()
-			// Check if it has an existing container
-			hasContainer, err := device.hasContainer(allContainers)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"event": "device_update",
-				}).Error("Could not check if device " + device.UDID + " has a container: " + err.Error())
-				continue
-			}
-			// If it has a container - remove it
-			if hasContainer {
-				go device.removeContainer()
-			}
-		}
+	// Check if the device has an already created container
+	// Also append the container data to the device struct if it does
+	container := device.findContainer(allContainers)
+	if container != nil {
+		device.setContainer(*container)
 	}
+
+	device.reconcileContainer(container)
 }
 
+// Get copies of the registered devices that are safe to use without configMu
 func GetConfigDevices() []*Device {
-	return Config.Devices
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	devices := []*Device{}
+	for _, device := range Config.Devices {
+		devices = append(devices, device.clone())
+	}
+	return devices
 }
 
 func devicesWatcher() {
@@ -143,8 +143,10 @@ func devicesWatcher() {
 
 					// Check if the created file was a symlink for a device
 					if strings.HasPrefix(fileName, "/dev/device_") {
+						configMu.Lock()
 						updateDevicesConnectedStatus()
 						updateDevices()
+						configMu.Unlock()
 					}
 				}
 
@@ -0,0 +1,292 @@
+package device
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	discoveredDevices = make(map[string]*Device)
+	discoveryMu       sync.Mutex
+)
+
+var physicalSizeRegex = regexp.MustCompile(`Physical size:\s*(\d+x\d+)`)
+
+// Screen sizes in points of the iPhone models by their lockdown product type
+// The screen size cannot be read without a paired session so it is derived from the model
+var iosScreenSizes = map[string]string{
+	"iPhone6,1":  "320x568",
+	"iPhone6,2":  "320x568",
+	"iPhone8,4":  "320x568",
+	"iPhone7,2":  "375x667",
+	"iPhone8,1":  "375x667",
+	"iPhone9,1":  "375x667",
+	"iPhone9,3":  "375x667",
+	"iPhone10,1": "375x667",
+	"iPhone10,4": "375x667",
+	"iPhone12,8": "375x667",
+	"iPhone14,6": "375x667",
+	"iPhone7,1":  "414x736",
+	"iPhone8,2":  "414x736",
+	"iPhone9,2":  "414x736",
+	"iPhone9,4":  "414x736",
+	"iPhone10,2": "414x736",
+	"iPhone10,5": "414x736",
+	"iPhone10,3": "375x812",
+	"iPhone10,6": "375x812",
+	"iPhone11,2": "375x812",
+	"iPhone12,3": "375x812",
+	"iPhone13,1": "375x812",
+	"iPhone14,4": "375x812",
+	"iPhone11,4": "414x896",
+	"iPhone11,6": "414x896",
+	"iPhone11,8": "414x896",
+	"iPhone12,1": "414x896",
+	"iPhone12,5": "414x896",
+	"iPhone13,2": "390x844",
+	"iPhone13,3": "390x844",
+	"iPhone14,2": "390x844",
+	"iPhone14,5": "390x844",
+	"iPhone14,7": "390x844",
+	"iPhone13,4": "428x926",
+	"iPhone14,3": "428x926",
+	"iPhone14,8": "428x926",
+	"iPhone15,2": "393x852",
+	"iPhone15,4": "393x852",
+	"iPhone16,1": "393x852",
+	"iPhone15,3": "430x932",
+	"iPhone15,5": "430x932",
+	"iPhone16,2": "430x932",
+}
+
+// Periodically look for connected devices that are not registered in config.json
+// Android devices are discovered through the adb server and iOS devices through usbmuxd
+func devicesDiscovery() {
+	if Config.EnvConfig.DeviceDiscovery != "true" {
+		return
+	}
+
+	fmt.Println("Starting devices discovery")
+	for {
+		discoverDevices()
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// Update the discovered devices with the currently connected unregistered devices
+func discoverDevices() {
+	found := make(map[string]*Device)
+
+	for _, device := range discoverAndroidDevices() {
+		found[device.UDID] = device
+	}
+	for _, device := range discoverIOSDevices() {
+		found[device.UDID] = device
+	}
+
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+
+	for udid := range discoveredDevices {
+		if _, ok := found[udid]; !ok {
+			delete(discoveredDevices, udid)
+		}
+	}
+	for udid, device := range found {
+		if _, ok := discoveredDevices[udid]; !ok {
+			log.WithFields(log.Fields{
+				"event": "device_discovery",
+			}).Info("Discovered unregistered " + device.OS + " device with udid: " + udid)
+		}
+		discoveredDevices[udid] = device
+	}
+}
+
+// Get the unregistered Android devices attached to the adb server
+func discoverAndroidDevices() []*Device {
+	client := newADBClient()
+	serials, err := client.listDevices()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "device_discovery",
+		}).Debug("Could not list devices from adb server: " + err.Error())
+		return nil
+	}
+
+	var devices []*Device
+	for _, serial := range serials {
+		// Skip devices connected over network, only USB devices can be registered
+		if strings.Contains(serial, ":") || isRegistered(serial) {
+			continue
+		}
+
+		device := &Device{
+			UDID:       serial,
+			OS:         "android",
+			Discovered: true,
+		}
+
+		manufacturer, _ := client.shell(serial, "getprop ro.product.manufacturer")
+		model, _ := client.shell(serial, "getprop ro.product.model")
+		device.Model = strings.TrimSpace(manufacturer + " " + model)
+		device.OSVersion, _ = client.shell(serial, "getprop ro.build.version.release")
+
+		screenSize, err := client.shell(serial, "wm size")
+		if err == nil {
+			matches := physicalSizeRegex.FindStringSubmatch(screenSize)
+			if len(matches) == 2 {
+				device.ScreenSize = matches[1]
+			}
+		}
+
+		device.Name = defaultDeviceName(device.Model)
+		devices = append(devices, device)
+	}
+
+	return devices
+}
+
+// Get the unregistered iOS devices attached to usbmuxd
+// The screen size is known only for the iPhone models in iosScreenSizes, for other models it has to be provided when adopting the device
+func discoverIOSDevices() []*Device {
+	client := newUsbmuxdClient()
+	usbmuxdDevices, err := client.listDevices()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "device_discovery",
+		}).Debug("Could not list devices from usbmuxd: " + err.Error())
+		return nil
+	}
+
+	var devices []*Device
+	for _, usbmuxdDevice := range usbmuxdDevices {
+		udid := usbmuxdDevice.Properties.SerialNumber
+		if udid == "" || isRegistered(udid) {
+			continue
+		}
+
+		device := &Device{
+			UDID:       udid,
+			OS:         "ios",
+			Discovered: true,
+		}
+
+		values, err := client.lockdownValues(usbmuxdDevice.DeviceID, "ProductType", "ProductVersion", "DeviceName")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "device_discovery",
+			}).Debug("Could not read lockdown values for device " + udid + ": " + err.Error())
+		}
+		device.Model = values["ProductType"]
+		device.OSVersion = values["ProductVersion"]
+		device.ScreenSize = iosScreenSizes[device.Model]
+		device.Name = defaultDeviceName(values["DeviceName"])
+		if device.Name == "" {
+			device.Name = defaultDeviceName(device.Model)
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices
+}
+
+// Generate a device name without spaces and special characters
+func defaultDeviceName(value string) string {
+	var name strings.Builder
+	for _, char := range strings.TrimSpace(value) {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9', char == '_':
+			name.WriteRune(char)
+		case char == ' ' || char == '-':
+			name.WriteRune('_')
+		}
+	}
+	return name.String()
+}
+
+// Check if a device is registered in config.json
+func isRegistered(udid string) bool {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	return getDeviceByUDID(udid) != nil
+}
+
+// Get the discovered devices that are not registered in config.json
+func GetDiscoveredDevices() []*Device {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+
+	var devices []*Device
+	for _, device := range discoveredDevices {
+		// Skip devices registered since the last discovery
+		if isRegistered(device.UDID) {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].UDID < devices[j].UDID
+	})
+
+	return devices
+}
+
+// Register a discovered device using the discovered data
+// Non-empty fields of the provided overrides replace the discovered values
+func AdoptDevice(udid string, overrides *Device) error {
+	discoveryMu.Lock()
+	discoveredDevice, ok := discoveredDevices[udid]
+	discoveryMu.Unlock()
+	if !ok {
+		return ErrDeviceNotFound
+	}
+
+	device := *discoveredDevice
+	device.Discovered = false
+	if overrides != nil {
+		if overrides.Name != "" {
+			device.Name = overrides.Name
+		}
+		if overrides.OSVersion != "" {
+			device.OSVersion = overrides.OSVersion
+		}
+		if overrides.ScreenSize != "" {
+			device.ScreenSize = overrides.ScreenSize
+		}
+		if overrides.Model != "" {
+			device.Model = overrides.Model
+		}
+		if overrides.Image != "" {
+			device.Image = overrides.Image
+		}
+		if overrides.RunMode != "" {
+			device.RunMode = overrides.RunMode
+		}
+		if overrides.ContainerConfig != nil {
+			device.ContainerConfig = overrides.ContainerConfig
+		}
+		device.AppiumPort = overrides.AppiumPort
+		device.StreamPort = overrides.StreamPort
+		device.ContainerServerPort = overrides.ContainerServerPort
+		device.WDAPort = overrides.WDAPort
+	}
+
+	err := RegisterDevice(&device)
+	if err != nil {
+		return err
+	}
+
+	discoveryMu.Lock()
+	delete(discoveredDevices, udid)
+	discoveryMu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package device
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Fake adb server speaking the host protocol for `host:devices`, `host:transport` and `shell`
+type fakeADBServer struct {
+	// Payload of `host:devices`
+	devices string
+	// Output of the shell commands per device serial
+	shell map[string]map[string]string
+}
+
+func startFakeADBServer(t *testing.T, server *fakeADBServer) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (server *fakeADBServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	request, err := readADBRequest(conn)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case request == "host:devices":
+		fmt.Fprintf(conn, "OKAY%04x%s", len(server.devices), server.devices)
+	case strings.HasPrefix(request, "host:transport:"):
+		serial := strings.TrimPrefix(request, "host:transport:")
+		outputs, ok := server.shell[serial]
+		if !ok {
+			writeADBFail(conn, "device '"+serial+"' not found")
+			return
+		}
+		conn.Write([]byte("OKAY"))
+
+		// The connection is now a transport to the device
+		request, err = readADBRequest(conn)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(request, "shell:") {
+			writeADBFail(conn, "unsupported device service")
+			return
+		}
+		conn.Write([]byte("OKAY"))
+		output, ok := outputs[strings.TrimPrefix(request, "shell:")]
+		if ok {
+			conn.Write([]byte(output + "\n"))
+		}
+	default:
+		writeADBFail(conn, "unknown host service")
+	}
+}
+
+func readADBRequest(conn net.Conn) (string, error) {
+	lengthHex := make([]byte, 4)
+	_, err := io.ReadFull(conn, lengthHex)
+	if err != nil {
+		return "", err
+	}
+	length, err := strconv.ParseUint(string(lengthHex), 16, 32)
+	if err != nil {
+		return "", err
+	}
+	request := make([]byte, length)
+	_, err = io.ReadFull(conn, request)
+	return string(request), err
+}
+
+func writeADBFail(conn net.Conn, message string) {
+	fmt.Fprintf(conn, "FAIL%04x%s", len(message), message)
+}
+
+type fakeUsbmuxdDevice struct {
+	id             int
+	serial         string
+	connectionType string
+	// Lockdown values readable without pairing
+	values map[string]string
+}
+
+// Fake usbmuxd handling the plist `ListDevices` and `Connect` messages and lockdownd `GetValue` requests
+type fakeUsbmuxd struct {
+	devices []fakeUsbmuxdDevice
+}
+
+func startFakeUsbmuxd(t *testing.T, server *fakeUsbmuxd) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "usbmuxd")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return socket
+}
+
+func (server *fakeUsbmuxd) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var message map[string]interface{}
+	err := usbmuxdReceive(conn, &message)
+	if err != nil {
+		return
+	}
+
+	switch message["MessageType"] {
+	case "ListDevices":
+		var deviceList []interface{}
+		for _, device := range server.devices {
+			deviceList = append(deviceList, map[string]interface{}{
+				"DeviceID":    device.id,
+				"MessageType": "Attached",
+				"Properties": map[string]interface{}{
+					"DeviceID":       device.id,
+					"SerialNumber":   device.serial,
+					"ConnectionType": device.connectionType,
+				},
+			})
+		}
+		usbmuxdSend(conn, map[string]interface{}{"DeviceList": deviceList})
+	case "Connect":
+		device := server.device(fmt.Sprint(message["DeviceID"]))
+		// Port 62078 in network byte order
+		if device == nil || fmt.Sprint(message["PortNumber"]) != "32498" {
+			usbmuxdSend(conn, map[string]interface{}{"MessageType": "Result", "Number": 3})
+			return
+		}
+		usbmuxdSend(conn, map[string]interface{}{"MessageType": "Result", "Number": 0})
+
+		// The connection is now a tunnel to lockdownd
+		for {
+			var request map[string]interface{}
+			err := lockdownReceive(conn, &request)
+			if err != nil {
+				return
+			}
+			key := fmt.Sprint(request["Key"])
+			value, ok := device.values[key]
+			if request["Request"] != "GetValue" || !ok {
+				lockdownSend(conn, map[string]interface{}{"Key": key, "Error": "MissingValue"})
+				continue
+			}
+			lockdownSend(conn, map[string]interface{}{"Key": key, "Value": value})
+		}
+	default:
+		usbmuxdSend(conn, map[string]interface{}{"MessageType": "Result", "Number": 1})
+	}
+}
+
+func (server *fakeUsbmuxd) device(id string) *fakeUsbmuxdDevice {
+	for i, device := range server.devices {
+		if strconv.Itoa(device.id) == id {
+			return &server.devices[i]
+		}
+	}
+	return nil
+}
+
+func TestDiscoverDevices(t *testing.T) {
+	registered := newTestDevice("registered1", true)
+	setupFakeProvider(t, registered)
+
+	adbAddress := startFakeADBServer(t, &fakeADBServer{
+		devices: "serial1\tdevice\n192.168.1.5:5555\tdevice\nserial2\tunauthorized\nregistered1\tdevice\nserial3\tdevice\n",
+		shell: map[string]map[string]string{
+			"serial1": {
+				"getprop ro.product.manufacturer":  "Google",
+				"getprop ro.product.model":         "Pixel 7",
+				"getprop ro.build.version.release": "13",
+				"wm size":                          "Physical size: 1080x2400\nOverride size: 720x1600",
+			},
+		},
+	})
+	usbmuxdSocket := startFakeUsbmuxd(t, &fakeUsbmuxd{devices: []fakeUsbmuxdDevice{
+		{
+			id:             1,
+			serial:         "ios1",
+			connectionType: "USB",
+			values:         map[string]string{"ProductType": "iPhone12,8", "ProductVersion": "16.5", "DeviceName": "Nikola's iPhone"},
+		},
+		{
+			id:             2,
+			serial:         "ios2",
+			connectionType: "Network",
+			values:         map[string]string{"ProductType": "iPhone14,5"},
+		},
+		{
+			id:             3,
+			serial:         "ios3",
+			connectionType: "USB",
+			values:         map[string]string{"ProductType": "iPad13,4", "ProductVersion": "17.0"},
+		},
+	}})
+
+	configMu.Lock()
+	Config.EnvConfig.ADBServer = adbAddress
+	Config.EnvConfig.UsbmuxdSocket = usbmuxdSocket
+	configMu.Unlock()
+	discoveryMu.Lock()
+	discoveredDevices = make(map[string]*Device)
+	discoveryMu.Unlock()
+
+	discoverDevices()
+
+	expected := []Device{
+		// The screen size is derived from the iPhone model
+		{UDID: "ios1", OS: "ios", Name: "Nikolas_iPhone", OSVersion: "16.5", ScreenSize: "375x667", Model: "iPhone12,8", Discovered: true},
+		// Unknown models have no screen size
+		{UDID: "ios3", OS: "ios", Name: "iPad134", OSVersion: "17.0", Model: "iPad13,4", Discovered: true},
+		{UDID: "serial1", OS: "android", Name: "Google_Pixel_7", OSVersion: "13", ScreenSize: "1080x2400", Model: "Google Pixel 7", Discovered: true},
+		// Devices that cannot be queried are still discovered
+		{UDID: "serial3", OS: "android", Discovered: true},
+	}
+	var discovered []Device
+	for _, device := range GetDiscoveredDevices() {
+		discovered = append(discovered, *device)
+	}
+	if !reflect.DeepEqual(discovered, expected) {
+		t.Errorf("expected discovered devices\n%+v\ngot\n%+v", expected, discovered)
+	}
+
+	// Devices that are no longer attached are dropped on the next discovery
+	configMu.Lock()
+	Config.EnvConfig.UsbmuxdSocket = filepath.Join(t.TempDir(), "missing")
+	configMu.Unlock()
+	discoverDevices()
+
+	var udids []string
+	for _, device := range GetDiscoveredDevices() {
+		udids = append(udids, device.UDID)
+	}
+	if !reflect.DeepEqual(udids, []string{"serial1", "serial3"}) {
+		t.Errorf("expected the iOS devices to be dropped, got %v", udids)
+	}
+}
+
+func TestADBClientShellFailure(t *testing.T) {
+	address := startFakeADBServer(t, &fakeADBServer{})
+	client := &adbClient{address: address}
+
+	_, err := client.shell("unknown", "getprop ro.product.model")
+	if err == nil || err.Error() != "adb request `host:transport:unknown` failed: device 'unknown' not found" {
+		t.Errorf("expected the adb failure message, got %v", err)
+	}
+}
+
+func TestDefaultDeviceName(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"Pixel 7", "Pixel_7"},
+		{" Galaxy-S23 Ultra ", "Galaxy_S23_Ultra"},
+		{"Nikola's iPhone", "Nikolas_iPhone"},
+		{"iPhone12,8", "iPhone128"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if name := defaultDeviceName(test.value); name != test.expected {
+			t.Errorf("expected name %q for %q, got %q", test.expected, test.value, name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package device
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Device state transitions recorded in the events log
+const (
+	EventRegistered         = "registered"
+	EventUnregistered       = "unregistered"
+	EventConnected          = "connected"
+	EventDisconnected       = "disconnected"
+	EventContainerCreated   = "container_created"
+	EventContainerRestarted = "container_restarted"
+	EventContainerRemoved   = "container_removed"
+	EventContainerAdopted   = "container_adopted"
+	EventContainerDied      = "container_died"
+	EventQuarantined        = "quarantined"
+	EventQuarantineCleared  = "quarantine_cleared"
+	EventHealthy            = "healthy"
+	EventUnhealthy          = "unhealthy"
+	EventFlapping           = "flapping"
+	EventFlappingStopped    = "flapping_stopped"
+	EventSessionCreated     = "session_created"
+)
+
+// Maximum number of events kept per device by the in-process stores
+const maxEventsPerDevice = 1000
+
+// A timestamped state transition of a device
+type DeviceEvent struct {
+	ID   string `json:"id,omitempty"`
+	UDID string `json:"udid"`
+	Type string `json:"type"`
+	// Unix timestamp in milliseconds
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message,omitempty"`
+}
+
+// Filter for querying device events, empty fields match everything
+type EventFilter struct {
+	UDID string
+	// Only events with a timestamp at or after this unix timestamp in milliseconds
+	Since int64
+	Type  string
+}
+
+// Check if the event matches the filter
+func (filter EventFilter) matches(event DeviceEvent) bool {
+	if filter.UDID != "" && event.UDID != filter.UDID {
+		return false
+	}
+	if filter.Since != 0 && event.Timestamp < filter.Since {
+		return false
+	}
+	if filter.Type != "" && event.Type != filter.Type {
+		return false
+	}
+	return true
+}
+
+// Record a state transition of the device in the events log
+func (device *Device) recordEvent(eventType string, message string) {
+	if store == nil {
+		return
+	}
+
+	event := DeviceEvent{
+		UDID:      device.UDID,
+		Type:      eventType,
+		Timestamp: time.Now().UnixMilli(),
+		Message:   message,
+	}
+
+	err := store.InsertEvent(event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "insert_device_event",
+		}).Error("Could not record " + eventType + " event for device " + device.UDID + ": " + err.Error())
+	}
+}
+
+// Get the recorded events of a device ordered by timestamp
+func GetDeviceEvents(filter EventFilter) ([]DeviceEvent, error) {
+	events, err := store.ListEvents(filter)
+	if err != nil {
+		return nil, err
+	}
+	if events == nil {
+		events = []DeviceEvent{}
+	}
+	return events, nil
+}
@@ -0,0 +1,100 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrCommandNotAllowed = errors.New("command is not allowed")
+	// The runtime could not stop the command when the context was done, it may still be running in the container
+	ErrExecNotStopped = errors.New("command was not stopped, it may still be running in the container")
+)
+
+// Commands allowed to run in the device containers per OS
+// An entry allows the commands starting with its words, e.g. `adb shell getprop` or just `adb`
+type ExecConfig struct {
+	Android []string `json:"android,omitempty"`
+	IOS     []string `json:"ios,omitempty"`
+}
+
+func (config ExecConfig) forOS(deviceOS string) []string {
+	switch deviceOS {
+	case "android":
+		return config.Android
+	case "ios":
+		return config.IOS
+	}
+	return nil
+}
+
+// Check if the command starts with the words of an allowlist entry
+func commandAllowed(allowlist []string, cmd []string) bool {
+	for _, entry := range allowlist {
+		words := strings.Fields(entry)
+		if len(words) == 0 || len(words) > len(cmd) {
+			continue
+		}
+
+		allowed := true
+		for i, word := range words {
+			if cmd[i] != word {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Run an allowed command in the container of a device and call handle for each output line
+// Returns the exit code of the command, when the context is done the command is stopped
+// or ErrExecNotStopped is returned if the runtime cannot stop it
+func ExecInDevice(ctx context.Context, udid string, cmd []string, handle func(LogLine) error) (int, error) {
+	configMu.Lock()
+	device := getDeviceByUDID(udid)
+	if device == nil {
+		configMu.Unlock()
+		return 0, ErrDeviceNotFound
+	}
+	if device.Container == nil {
+		configMu.Unlock()
+		return 0, ErrNoContainer
+	}
+	if len(cmd) == 0 || !commandAllowed(Config.ExecConfig.forOS(device.OS), cmd) {
+		configMu.Unlock()
+		return 0, ErrCommandNotAllowed
+	}
+	containerID := device.Container.ContainerID
+	configMu.Unlock()
+
+	log.WithFields(log.Fields{
+		"event": "device_exec",
+	}).Info("Running `" + strings.Join(cmd, " ") + "` in container with ID: " + containerID + " of device with udid: " + udid)
+
+	// The runtimes can write stdout and stderr concurrently
+	var mu sync.Mutex
+	lockedHandle := func(line LogLine) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return handle(line)
+	}
+	stdout := &logLineWriter{stream: "stdout", handle: lockedHandle}
+	stderr := &logLineWriter{stream: "stderr", handle: lockedHandle}
+
+	exitCode, err := runtimeForContainer(containerID).Exec(ctx, containerID, cmd, stdout, stderr)
+	if flushErr := stdout.flush(); err == nil {
+		err = flushErr
+	}
+	if flushErr := stderr.flush(); err == nil {
+		err = flushErr
+	}
+	return exitCode, err
+}
@@ -0,0 +1,116 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCommandAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist []string
+		cmd       []string
+		expected  bool
+	}{
+		{"exact match", []string{"adb shell"}, []string{"adb", "shell"}, true},
+		{"longer command", []string{"adb shell"}, []string{"adb", "shell", "getprop"}, true},
+		{"command shorter than the entry", []string{"adb shell"}, []string{"adb"}, false},
+		{"words are not prefixes", []string{"adb shell"}, []string{"adbx", "shell"}, false},
+		{"last word is not a prefix", []string{"adb shell"}, []string{"adb", "shellx"}, false},
+		{"extra spaces in the entry", []string{"  adb   shell "}, []string{"adb", "shell", "ls"}, true},
+		{"any entry matches", []string{"ios info", "adb shell"}, []string{"adb", "shell"}, true},
+		{"empty allowlist", nil, []string{"adb", "shell"}, false},
+		{"empty entry", []string{""}, []string{"adb"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := commandAllowed(test.allowlist, test.cmd); allowed != test.expected {
+				t.Errorf("expected allowed %v, got %v", test.expected, allowed)
+			}
+		})
+	}
+}
+
+// Set up a device with a running container in the fake runtime
+func setupExecTest(t *testing.T, execConfig ExecConfig) *Device {
+	t.Helper()
+
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+	configMu.Lock()
+	Config.ExecConfig = execConfig
+	configMu.Unlock()
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+	configMu.Lock()
+	device.setContainer(listContainers(t, fake)[0])
+	configMu.Unlock()
+	return device
+}
+
+func TestExecInDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		execConfig ExecConfig
+		cmd        []string
+		err        error
+	}{
+		{"allowed command", ExecConfig{Android: []string{"adb shell"}}, []string{"adb", "shell", "getprop"}, nil},
+		{"empty allowlist rejects everything", ExecConfig{}, []string{"adb", "shell", "getprop"}, ErrCommandNotAllowed},
+		{"allowlist of the other OS is not applied", ExecConfig{IOS: []string{"adb shell"}}, []string{"adb", "shell", "getprop"}, ErrCommandNotAllowed},
+		{"empty command", ExecConfig{Android: []string{"adb shell"}}, nil, ErrCommandNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := setupExecTest(t, test.execConfig)
+
+			var lines []LogLine
+			_, err := ExecInDevice(context.Background(), device.UDID, test.cmd, func(line LogLine) error {
+				lines = append(lines, line)
+				return nil
+			})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if test.err == nil && (len(lines) != 1 || lines[0].Line != "adb shell getprop" || lines[0].Stream != "stdout") {
+				t.Errorf("expected the command output, got %+v", lines)
+			}
+		})
+	}
+}
+
+func TestExecInDeviceTimeout(t *testing.T) {
+	device := setupExecTest(t, ExecConfig{Android: []string{"sleep"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ExecInDevice(ctx, device.UDID, []string{"sleep", "10"}, func(line LogLine) error {
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the command to be stopped on the timeout, it took %s", elapsed)
+	}
+}
+
+func TestExecInDeviceErrors(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	setupFakeProvider(t, device)
+
+	_, err := ExecInDevice(context.Background(), "unknown", []string{"adb"}, nil)
+	if !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("expected %v, got %v", ErrDeviceNotFound, err)
+	}
+	_, err = ExecInDevice(context.Background(), device.UDID, []string{"adb"}, nil)
+	if !errors.Is(err, ErrNoContainer) {
+		t.Errorf("expected %v, got %v", ErrNoContainer, err)
+	}
+}
@@ -0,0 +1,160 @@
+package device
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A provider container that does not belong to a registered connected device
+type OrphanContainer struct {
+	ContainerID string `json:"container_id"`
+	Name        string `json:"name"`
+	UDID        string `json:"udid"`
+	Runtime     string `json:"runtime"`
+	Reason      string `json:"reason"`
+	Removed     bool   `json:"removed"`
+	Error       string `json:"error,omitempty"`
+}
+
+type ContainersGCResult struct {
+	DryRun     bool              `json:"dry_run"`
+	Containers []OrphanContainer `json:"containers"`
+}
+
+const (
+	defaultOrphanGCIntervalSec = 300
+	defaultOrphanGCGraceSec    = 600
+)
+
+func orphanGCInterval() time.Duration {
+	if Config.EnvConfig.OrphanGCIntervalSec > 0 {
+		return time.Duration(Config.EnvConfig.OrphanGCIntervalSec) * time.Second
+	}
+	return defaultOrphanGCIntervalSec * time.Second
+}
+
+// How long a device can be disconnected before its container is collected
+func orphanGCGrace() time.Duration {
+	if Config.EnvConfig.OrphanGCGraceSec > 0 {
+		return time.Duration(Config.EnvConfig.OrphanGCGraceSec) * time.Second
+	}
+	return defaultOrphanGCGraceSec * time.Second
+}
+
+// Remember when the device was disconnected for the orphan containers grace period
+func (device *Device) trackDisconnect(now time.Time) {
+	if device.Connected {
+		device.disconnectedAt = time.Time{}
+		return
+	}
+	if device.disconnectedAt.IsZero() {
+		device.disconnectedAt = now
+	}
+}
+
+// Periodically remove the provider containers that are left without a device
+func orphanContainersGC() {
+	for {
+		time.Sleep(orphanGCInterval())
+		_, err := CollectOrphanContainers(false)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "containers_gc",
+			}).Error("Could not collect orphan containers: " + err.Error())
+		}
+	}
+}
+
+// Find the provider containers of unregistered devices, of devices disconnected longer than the grace period
+// and duplicate containers of a device, and remove them unless dryRun is set
+func CollectOrphanContainers(dryRun bool) (ContainersGCResult, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	result := ContainersGCResult{DryRun: dryRun, Containers: []OrphanContainer{}}
+	allContainers, err := getHostContainers()
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now()
+	for _, container := range allContainers {
+		udid := containerDeviceUDID(container)
+		if udid == "" {
+			continue
+		}
+
+		device := getDeviceByUDID(udid)
+		reason := orphanReason(device, container, allContainers, now)
+		if reason == "" {
+			continue
+		}
+
+		runtime := runtimeForContainer(container.ID)
+		orphan := OrphanContainer{
+			ContainerID: container.ID,
+			Name:        container.Name,
+			UDID:        udid,
+			Runtime:     runtime.Name(),
+			Reason:      reason,
+		}
+		if !dryRun {
+			orphan.Removed, orphan.Error = removeOrphanContainer(device, runtime, container, reason)
+		}
+		result.Containers = append(result.Containers, orphan)
+	}
+
+	if len(result.Containers) > 0 {
+		log.WithFields(log.Fields{
+			"event": "containers_gc",
+		}).Info("Found " + strconv.Itoa(len(result.Containers)) + " orphan containers, dry run: " + strconv.FormatBool(dryRun))
+	}
+	return result, nil
+}
+
+// Get why the container should be collected, empty if it should be kept
+func orphanReason(device *Device, container ContainerInfo, allContainers []ContainerInfo, now time.Time) string {
+	if device == nil {
+		return "device is not registered"
+	}
+	// Containers of a device in the middle of a transition are left to the transition
+	if lifecycles.get(device.UDID).isScheduled() {
+		return ""
+	}
+	if !device.Connected && !device.disconnectedAt.IsZero() && now.Sub(device.disconnectedAt) > orphanGCGrace() {
+		return "device is disconnected for more than " + orphanGCGrace().String()
+	}
+	if deviceContainer := device.findContainer(allContainers); deviceContainer != nil && deviceContainer.ID != container.ID {
+		return "duplicate container of the device"
+	}
+	return ""
+}
+
+// Stop and remove an orphan container, returns if it was removed and the error message if not
+// Should be called with configMu held
+func removeOrphanContainer(device *Device, runtime ContainerRuntime, container ContainerInfo, reason string) (bool, string) {
+	log.WithFields(log.Fields{
+		"event": "containers_gc",
+	}).Info("Removing orphan container with ID: " + container.ID + ", " + reason)
+
+	err := removeContainer(context.Background(), runtime, container.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "containers_gc",
+		}).Error("Could not remove orphan container with ID: " + container.ID + ": " + err.Error())
+		return false, err.Error()
+	}
+
+	if device != nil {
+		device.recordEvent(EventContainerRemoved, "Removed orphan container with ID: "+container.ID+", "+reason)
+		if device.Container != nil && device.Container.ContainerID == container.ID {
+			device.Container = nil
+			lifecycles.get(device.UDID).observe(StateAbsent)
+			device.updateDB()
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,55 @@
+package device
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCollectOrphanContainersOnlyCollectsOwnContainers(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	specs := map[string]ContainerSpec{
+		// Labeled container of this provider for a device that is not registered
+		"unregistered": {Name: "androidDevice_udid2", Labels: map[string]string{labelProvider: "test-host", labelUDID: "udid2"}},
+		// Labeled container of another provider sharing the host
+		"other provider": {Name: "androidDevice_udid3", Labels: map[string]string{labelProvider: "other-host", labelUDID: "udid3"}},
+		// Unlabeled container of an older provider version for a registered device
+		"legacy registered": {Name: "androidDevice_udid1"},
+		// Unlabeled container that does not match a registered device
+		"legacy unregistered": {Name: "iosDevice_udid4"},
+	}
+	containerIDs := make(map[string]string)
+	for name, spec := range specs {
+		containerID, err := fake.Create(context.Background(), spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		containerIDs[name] = containerID
+	}
+
+	result, err := CollectOrphanContainers(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Containers) != 1 || result.Containers[0].ContainerID != containerIDs["unregistered"] {
+		t.Fatalf("expected only container %s to be collected, got %+v", containerIDs["unregistered"], result.Containers)
+	}
+	if result.Containers[0].Removed {
+		t.Errorf("expected the container not to be removed on a dry run")
+	}
+
+	_, err = CollectOrphanContainers(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := listContainers(t, fake)
+	if len(containers) != len(specs)-1 {
+		t.Fatalf("expected %d containers to be left, got %d", len(specs)-1, len(containers))
+	}
+	for _, container := range containers {
+		if container.ID == containerIDs["unregistered"] {
+			t.Errorf("expected container %s to be removed", container.ID)
+		}
+	}
+}
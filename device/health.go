@@ -5,76 +5,261 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/shamanec/GADS-devices-provider/util"
 )
 
-// Check if a device is healthy by checking Appium and WebDriverAgent(for iOS) services
-func GetDeviceHealth(udid string) (bool, error) {
-	device := GetDeviceByUDID(udid)
+// Components of a device checked by the health check
+const (
+	ComponentContainer       = "container"
+	ComponentAppium          = "appium"
+	ComponentWDA             = "wda"
+	ComponentStream          = "stream"
+	ComponentContainerServer = "container_server"
+	ComponentSession         = "session"
+)
 
-	allGood := false
-	allGood, err := device.appiumHealthy()
-	if err != nil {
-		return false, err
-	}
+const healthCheckTimeout = 3 * time.Second
 
-	if allGood {
-		err = device.checkAppiumSession()
-		if err != nil {
-			return false, err
-		}
+var healthClient = &http.Client{Timeout: healthCheckTimeout}
+
+// Result of the health check of a single device component
+type ComponentHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	// Duration of the check in milliseconds
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Health of a device and each of its components, the device is healthy when all components are healthy
+type HealthReport struct {
+	Healthy bool `json:"healthy"`
+	// Unix timestamp in milliseconds
+	Timestamp  int64             `json:"timestamp"`
+	Components []ComponentHealth `json:"components"`
+}
+
+// Get the health report of a device, the remote control sessions are created if they are missing
+func GetDeviceHealth(udid string) (HealthReport, error) {
+	configMu.Lock()
+	device := getDeviceByUDID(udid)
+	if device == nil {
+		configMu.Unlock()
+		return HealthReport{}, ErrDeviceNotFound
+	}
+	// The checks run on a copy so they do not block the device updates
+	snapshot := device.clone()
+	configMu.Unlock()
+
+	report := snapshot.healthReport(true)
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if getDeviceByUDID(udid) == device {
+		// Keep the remote control sessions created by the check
+		device.AppiumSessionID = snapshot.AppiumSessionID
+		device.WDASessionID = snapshot.WDASessionID
+		device.applyHealthReport(report)
 	}
+	return report, nil
+}
 
+// Check all components of the device
+// Missing remote control sessions are created if ensureSessions is set, otherwise only the existing sessions are validated
+func (device *Device) healthReport(ensureSessions bool) HealthReport {
+	report := HealthReport{Timestamp: time.Now().UnixMilli()}
+
+	report.Components = append(report.Components, checkComponent(ComponentContainer, device.containerHealthy))
+
+	appium := checkComponent(ComponentAppium, func() error {
+		return checkStatusEndpoint(device.AppiumPort)
+	})
+	report.Components = append(report.Components, appium)
+
+	wdaHealthy := true
 	if device.OS == "ios" {
-		allGood, err = device.wdaHealthy()
-		if err != nil {
-			return false, err
+		wda := checkComponent(ComponentWDA, func() error {
+			return checkStatusEndpoint(device.WDAPort)
+		})
+		wdaHealthy = wda.Healthy
+		report.Components = append(report.Components, wda)
+	}
+
+	report.Components = append(report.Components, checkComponent(ComponentStream, func() error {
+		return checkReachable(device.StreamURL())
+	}))
+	report.Components = append(report.Components, checkComponent(ComponentContainerServer, func() error {
+		return checkReachable("http://localhost:" + device.ContainerServerPort)
+	}))
+
+	report.Components = append(report.Components, checkComponent(ComponentSession, func() error {
+		if !appium.Healthy {
+			return errors.New("Appium is not healthy")
 		}
-		if allGood {
-			err = device.checkWDASession()
-			if err != nil {
-				return false, err
-			}
+		if ensureSessions {
+			return device.ensureSessions(wdaHealthy)
+		}
+		return device.validateSessions(wdaHealthy)
+	}))
+
+	report.Healthy = true
+	for _, component := range report.Components {
+		if !component.Healthy {
+			report.Healthy = false
 		}
 	}
+	return report
+}
 
-	return allGood, nil
+// Get the failed components with their errors, e.g. `appium: connection refused`
+func (report HealthReport) failures() string {
+	var failures []string
+	for _, component := range report.Components {
+		if !component.Healthy {
+			failures = append(failures, component.Name+": "+component.Error)
+		}
+	}
+	return strings.Join(failures, ", ")
 }
 
-// Check if the Appium server for a device is up
-func (device *Device) appiumHealthy() (bool, error) {
-	response, err := http.Get("http://localhost:" + device.AppiumPort + "/status")
+func checkComponent(name string, check func() error) ComponentHealth {
+	start := time.Now()
+	err := check()
+	component := ComponentHealth{
+		Name:      name,
+		Healthy:   err == nil,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
 	if err != nil {
-		return false, err
+		component.Error = err.Error()
+	}
+	return component
+}
+
+// Check if the device container is running
+// The status is kept up to date by the runtime events, so the runtime is not queried on every check
+func (device *Device) containerHealthy() error {
+	if device.Container == nil {
+		return errors.New("the device has no container")
+	}
+
+	status := device.Container.ContainerStatus
+	if !strings.HasPrefix(status, "Up") {
+		return errors.New("the container is " + strings.ToLower(status))
+	}
+	if strings.Contains(status, "(unhealthy)") {
+		return errors.New("the container is unhealthy")
+	}
+	return nil
+}
+
+// Check if the Appium or WebDriverAgent server on the port is up
+func checkStatusEndpoint(port string) error {
+	response, err := healthClient.Get("http://localhost:" + port + "/status")
+	if err != nil {
+		return err
 	}
 	defer response.Body.Close()
 
-	responseCode := response.StatusCode
+	if response.StatusCode != http.StatusOK {
+		return errors.New("/status responded with " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
 
-	if responseCode != 200 {
-		return false, nil
+// Check if the server behind the URL accepts connections without sending a request
+// Used for the streams which never finish responding
+func checkReachable(rawURL string) error {
+	endpoint, err := url.Parse(rawURL)
+	if err != nil {
+		return err
 	}
 
-	return true, nil
+	connection, err := net.DialTimeout("tcp", endpoint.Host, healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return connection.Close()
 }
 
-// Check if the WebDriverAgent server for an iOS device is up
-func (device *Device) wdaHealthy() (bool, error) {
-	response, err := http.Get("http://localhost:" + device.WDAPort + "/status")
+// Get the URL of the device screen stream
+func (device *Device) StreamURL() string {
+	if device.OS == "android" {
+		return "http://localhost:" + device.ContainerServerPort + "/stream"
+	}
+	return "http://localhost:" + device.StreamPort
+}
+
+// Check the remote control sessions and create them if they are missing
+func (device *Device) ensureSessions(wdaHealthy bool) error {
+	err := device.checkAppiumSession()
 	if err != nil {
-		return false, err
+		return err
 	}
-	defer response.Body.Close()
 
-	responseCode := response.StatusCode
-	if responseCode != 200 {
-		return false, nil
+	if device.OS == "ios" {
+		if !wdaHealthy {
+			return errors.New("WebDriverAgent is not healthy")
+		}
+		return device.checkWDASession()
+	}
+	return nil
+}
+
+// Check that the remote control sessions created by the provider are still valid without creating new ones
+func (device *Device) validateSessions(wdaHealthy bool) error {
+	if device.AppiumSessionID != "" {
+		response, err := healthClient.Get("http://localhost:" + device.AppiumPort + "/sessions")
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		var responseJson AppiumGetSessionsResponse
+		err = json.NewDecoder(response.Body).Decode(&responseJson)
+		if err != nil {
+			return err
+		}
+
+		valid := false
+		for _, session := range responseJson.Value {
+			if session.ID == device.AppiumSessionID {
+				valid = true
+			}
+		}
+		if !valid {
+			return errors.New("Appium session " + device.AppiumSessionID + " is no longer valid")
+		}
 	}
 
-	return true, nil
+	if device.OS == "ios" && device.WDASessionID != "" {
+		if !wdaHealthy {
+			return errors.New("WebDriverAgent is not healthy")
+		}
+
+		response, err := healthClient.Get("http://localhost:" + device.WDAPort + "/status")
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		var responseJson map[string]interface{}
+		err = json.NewDecoder(response.Body).Decode(&responseJson)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%v", responseJson["sessionId"]) != device.WDASessionID {
+			return errors.New("WebDriverAgent session " + device.WDASessionID + " is no longer valid")
+		}
+	}
+	return nil
 }
 
 func (device *Device) checkAppiumSession() error {
@@ -99,6 +284,7 @@ func (device *Device) checkAppiumSession() error {
 			return err
 		}
 		device.AppiumSessionID = sessionID
+		device.recordEvent(EventSessionCreated, "Created Appium session with ID: "+sessionID)
 		return nil
 	}
 
@@ -172,6 +358,7 @@ func (device *Device) checkWDASession() error {
 			device.WDASessionID = ""
 			return err
 		}
+		device.recordEvent(EventSessionCreated, "Created WebDriverAgent session with ID: "+sessionId)
 	}
 
 	device.WDASessionID = fmt.Sprintf("%v", responseJson["sessionId"])
@@ -233,3 +420,27 @@ type AppiumCreateSessionResponse struct {
 		SessionID string `json:"sessionId"`
 	} `json:"value"`
 }
+
+var sessionsClient = &http.Client{Timeout: 5 * time.Second}
+
+// Check if the device has an Appium session other than the one created by the provider for remote control
+func (device *Device) hasTestSession() bool {
+	response, err := sessionsClient.Get("http://localhost:" + device.AppiumPort + "/sessions")
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+
+	var responseJson AppiumGetSessionsResponse
+	err = json.NewDecoder(response.Body).Decode(&responseJson)
+	if err != nil {
+		return false
+	}
+
+	for _, session := range responseJson.Value {
+		if session.ID != device.AppiumSessionID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package device
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	defaultUnhealthyThreshold = 3
+	defaultHealthyThreshold   = 2
+	defaultFlapThreshold      = 4
+	defaultFlapWindowSec      = 300
+)
+
+// The current healthy or unhealthy state of a device
+type HealthState struct {
+	// Unix timestamp in milliseconds when the device entered its current state
+	Since  int64  `json:"since"`
+	Reason string `json:"reason,omitempty"`
+	// The device changed its state too often within the flap window
+	Flapping bool `json:"flapping,omitempty"`
+}
+
+// Consecutive failed health checks before a healthy device is marked unhealthy
+func unhealthyThreshold() int {
+	if Config.EnvConfig.UnhealthyThreshold > 0 {
+		return Config.EnvConfig.UnhealthyThreshold
+	}
+	return defaultUnhealthyThreshold
+}
+
+// Consecutive successful health checks before an unhealthy device is marked healthy
+func healthyThreshold() int {
+	if Config.EnvConfig.HealthyThreshold > 0 {
+		return Config.EnvConfig.HealthyThreshold
+	}
+	return defaultHealthyThreshold
+}
+
+// Health state changes within the flap window after which the device is flagged as flapping
+func flapThreshold() int {
+	if Config.EnvConfig.FlapThreshold > 0 {
+		return Config.EnvConfig.FlapThreshold
+	}
+	return defaultFlapThreshold
+}
+
+func flapWindow() time.Duration {
+	if Config.EnvConfig.FlapWindowSec > 0 {
+		return time.Duration(Config.EnvConfig.FlapWindowSec) * time.Second
+	}
+	return defaultFlapWindowSec * time.Second
+}
+
+// Update the device health, its events and the DB with the health report
+// The device changes its state only after enough consecutive checks with the same result
+// Should be called with configMu held
+func (device *Device) applyHealthReport(report HealthReport) {
+	if report.Healthy {
+		device.healthSuccesses++
+		device.healthFailures = 0
+		device.LastHealthyTimestamp = report.Timestamp
+	} else {
+		device.healthFailures++
+		device.healthSuccesses = 0
+	}
+	device.Health = &report
+
+	now := time.Now()
+	switch {
+	case device.HealthState == nil:
+		// The first check sets the initial state without waiting for the thresholds
+		device.setHealthState(report.Healthy, report.failures(), now)
+		if report.Healthy {
+			device.recordEvent(EventHealthy, "")
+		}
+	case !device.Healthy && report.Healthy && device.healthSuccesses >= healthyThreshold():
+		device.setHealthState(true, strconv.Itoa(device.healthSuccesses)+" consecutive successful health checks", now)
+		device.recordEvent(EventHealthy, device.HealthState.Reason)
+		device.trackHealthTransition(now)
+	case device.Healthy && !report.Healthy && device.healthFailures >= unhealthyThreshold():
+		device.setHealthState(false, report.failures(), now)
+		device.recordEvent(EventUnhealthy, device.HealthState.Reason)
+		device.trackHealthTransition(now)
+	default:
+		device.updateFlapping(now)
+	}
+
+	device.updateDB()
+}
+
+// Should be called with configMu held
+func (device *Device) setHealthState(healthy bool, reason string, now time.Time) {
+	flapping := false
+	if device.HealthState != nil {
+		flapping = device.HealthState.Flapping
+	}
+	device.Healthy = healthy
+	device.HealthState = &HealthState{
+		Since:    now.UnixMilli(),
+		Reason:   reason,
+		Flapping: flapping,
+	}
+}
+
+// Remember the state change for the flap detection
+// Should be called with configMu held
+func (device *Device) trackHealthTransition(now time.Time) {
+	device.healthTransitions = append(device.healthTransitions, now)
+	device.updateFlapping(now)
+}
+
+// Flag the device as flapping while it changed its state too often within the flap window
+// Should be called with configMu held
+func (device *Device) updateFlapping(now time.Time) {
+	var recent []time.Time
+	for _, transition := range device.healthTransitions {
+		if now.Sub(transition) <= flapWindow() {
+			recent = append(recent, transition)
+		}
+	}
+	device.healthTransitions = recent
+
+	flapping := len(recent) >= flapThreshold()
+	if device.HealthState == nil || device.HealthState.Flapping == flapping {
+		return
+	}
+
+	state := *device.HealthState
+	state.Flapping = flapping
+	device.HealthState = &state
+	if flapping {
+		device.recordEvent(EventFlapping, strconv.Itoa(len(recent))+" health state changes in the last "+flapWindow().String())
+	} else {
+		device.recordEvent(EventFlappingStopped, "")
+	}
+}
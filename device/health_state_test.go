@@ -0,0 +1,148 @@
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+// Health report with all components healthy or a failing Appium
+func testHealthReport(healthy bool) HealthReport {
+	report := HealthReport{Healthy: healthy, Timestamp: time.Now().UnixMilli()}
+	if healthy {
+		report.Components = []ComponentHealth{{Name: ComponentAppium, Healthy: true}}
+	} else {
+		report.Components = []ComponentHealth{{Name: ComponentAppium, Error: "connection refused"}}
+	}
+	return report
+}
+
+func TestApplyHealthReportThresholds(t *testing.T) {
+	tests := []struct {
+		name    string
+		reports []bool
+		// The device health after each report
+		expected []bool
+	}{
+		{"first check sets the state", []bool{false}, []bool{false}},
+		{"single failure does not flip", []bool{true, false, true}, []bool{true, true, true}},
+		{"unhealthy after 3 failures", []bool{true, false, false, false}, []bool{true, true, true, false}},
+		{"interrupted failures do not flip", []bool{true, false, false, true, false, false}, []bool{true, true, true, true, true, true}},
+		{"single success does not flip", []bool{false, true, false}, []bool{false, false, false}},
+		{"healthy after 2 successes", []bool{false, true, true}, []bool{false, false, true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := newTestDevice("udid1", true)
+			setupFakeProvider(t, device)
+
+			configMu.Lock()
+			defer configMu.Unlock()
+			for i, healthy := range test.reports {
+				device.applyHealthReport(testHealthReport(healthy))
+				if device.Healthy != test.expected[i] {
+					t.Fatalf("expected healthy %v after report %d, got %v", test.expected[i], i+1, device.Healthy)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyHealthReportState(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	setupFakeProvider(t, device)
+
+	configMu.Lock()
+	device.applyHealthReport(testHealthReport(true))
+	for i := 0; i < 3; i++ {
+		device.applyHealthReport(testHealthReport(false))
+	}
+	state := *device.HealthState
+	configMu.Unlock()
+
+	if state.Reason != "appium: connection refused" {
+		t.Errorf("expected the failures as the unhealthy reason, got %s", state.Reason)
+	}
+	waitForEvents(t, device.UDID, EventHealthy, 1)
+	waitForEvents(t, device.UDID, EventUnhealthy, 1)
+
+	configMu.Lock()
+	device.applyHealthReport(testHealthReport(true))
+	device.applyHealthReport(testHealthReport(true))
+	state = *device.HealthState
+	configMu.Unlock()
+
+	if state.Reason != "2 consecutive successful health checks" {
+		t.Errorf("expected the successful checks as the healthy reason, got %s", state.Reason)
+	}
+	waitForEvents(t, device.UDID, EventHealthy, 2)
+}
+
+func TestUpdateFlapping(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		// How long ago the health state changes happened
+		transitions []time.Duration
+		expected    bool
+	}{
+		{"no changes", nil, false},
+		{"3 changes in the window", []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute}, false},
+		{"4 changes in the window", []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 300 * time.Second}, true},
+		{"changes outside the window are dropped", []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 301 * time.Second}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := newTestDevice("udid1", true)
+			setupFakeProvider(t, device)
+
+			configMu.Lock()
+			defer configMu.Unlock()
+			device.HealthState = &HealthState{}
+			for _, ago := range test.transitions {
+				device.healthTransitions = append(device.healthTransitions, now.Add(-ago))
+			}
+
+			device.updateFlapping(now)
+			if device.HealthState.Flapping != test.expected {
+				t.Errorf("expected flapping %v, got %v", test.expected, device.HealthState.Flapping)
+			}
+		})
+	}
+}
+
+func TestApplyHealthReportFlapping(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	setupFakeProvider(t, device)
+
+	configMu.Lock()
+	device.applyHealthReport(testHealthReport(true))
+	// Each loop changes the health state twice
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 3; j++ {
+			device.applyHealthReport(testHealthReport(false))
+		}
+		device.applyHealthReport(testHealthReport(true))
+		device.applyHealthReport(testHealthReport(true))
+	}
+	flapping := device.HealthState.Flapping
+	healthy := device.Healthy
+	configMu.Unlock()
+
+	if !flapping || !healthy {
+		t.Fatalf("expected a healthy flapping device after 4 health state changes, got flapping %v and healthy %v", flapping, healthy)
+	}
+	waitForEvents(t, device.UDID, EventFlapping, 1)
+
+	// The flapping stops once the changes leave the window
+	configMu.Lock()
+	device.updateFlapping(time.Now().Add(flapWindow() + time.Second))
+	flapping = device.HealthState.Flapping
+	configMu.Unlock()
+
+	if flapping {
+		t.Error("expected the device to stop flapping after the window")
+	}
+	waitForEvents(t, device.UDID, EventFlappingStopped, 1)
+}
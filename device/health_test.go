@@ -0,0 +1,118 @@
+package device
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthReportFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		components []ComponentHealth
+		expected   string
+	}{
+		{"no components", nil, ""},
+		{"all healthy", []ComponentHealth{{Name: ComponentAppium, Healthy: true}, {Name: ComponentStream, Healthy: true}}, ""},
+		{
+			name: "failed components in order",
+			components: []ComponentHealth{
+				{Name: ComponentContainer, Error: "the container is exited (1)"},
+				{Name: ComponentAppium, Healthy: true},
+				{Name: ComponentSession, Error: "Appium is not healthy"},
+			},
+			expected: "container: the container is exited (1), session: Appium is not healthy",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := HealthReport{Components: test.components}
+			if failures := report.failures(); failures != test.expected {
+				t.Errorf("expected failures %q, got %q", test.expected, failures)
+			}
+		})
+	}
+}
+
+func TestCheckComponent(t *testing.T) {
+	component := checkComponent(ComponentAppium, func() error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	if component.Name != ComponentAppium || !component.Healthy || component.Error != "" {
+		t.Errorf("expected a healthy appium component, got %+v", component)
+	}
+	if component.LatencyMs < 20 {
+		t.Errorf("expected a latency of at least 20ms, got %dms", component.LatencyMs)
+	}
+
+	component = checkComponent(ComponentWDA, func() error {
+		return errors.New("connection refused")
+	})
+	if component.Name != ComponentWDA || component.Healthy || component.Error != "connection refused" {
+		t.Errorf("expected an unhealthy wda component with the error, got %+v", component)
+	}
+}
+
+func TestContainerHealthy(t *testing.T) {
+	tests := []struct {
+		name      string
+		container *DeviceContainer
+		expected  string
+	}{
+		{"no container", nil, "the device has no container"},
+		{"running", &DeviceContainer{ContainerStatus: "Up 3 minutes"}, ""},
+		{"running and healthy", &DeviceContainer{ContainerStatus: "Up 3 minutes (healthy)"}, ""},
+		{"running and unhealthy", &DeviceContainer{ContainerStatus: "Up (unhealthy)"}, "the container is unhealthy"},
+		{"exited", &DeviceContainer{ContainerStatus: "Exited (1)"}, "the container is exited (1)"},
+		{"created", &DeviceContainer{ContainerStatus: "Created"}, "the container is created"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := newTestDevice("udid1", true)
+			device.Container = test.container
+
+			err := device.containerHealthy()
+			message := ""
+			if err != nil {
+				message = err.Error()
+			}
+			if message != test.expected {
+				t.Errorf("expected error %q, got %q", test.expected, message)
+			}
+		})
+	}
+}
+
+func TestContainerHealthyFollowsRuntimeEvents(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+	container := listContainers(t, fake)[0]
+
+	configMu.Lock()
+	device.setContainer(container)
+	err := device.containerHealthy()
+	configMu.Unlock()
+	if err != nil {
+		t.Fatalf("expected the running container to be healthy, got %v", err)
+	}
+
+	handleRuntimeEvent(RuntimeEvent{
+		ContainerID: container.ID,
+		Action:      "stop",
+		Labels:      container.Labels,
+		Timestamp:   time.Now().Add(time.Second).UnixMilli(),
+	})
+
+	configMu.Lock()
+	err = device.containerHealthy()
+	configMu.Unlock()
+	if err == nil || err.Error() != "the container is exited" {
+		t.Errorf("expected the container to be exited after the event, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package device
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// Labels set on the device containers, used to find the container of a device
+const (
+	labelProvider   = "gads.provider"
+	labelUDID       = "gads.udid"
+	labelOS         = "gads.os"
+	labelImage      = "gads.image"
+	labelConfigHash = "gads.config_hash"
+)
+
+// ID of this provider in the container labels so providers sharing a container host do not manage each other's containers
+func providerID() string {
+	return Config.EnvConfig.DevicesHost
+}
+
+// Add the device labels to the spec, the config hash covers everything in the spec except the labels
+func (device *Device) labelSpec(spec ContainerSpec) (ContainerSpec, error) {
+	hash, err := specHash(spec)
+	if err != nil {
+		return spec, err
+	}
+
+	spec.Labels = map[string]string{
+		labelProvider:   providerID(),
+		labelUDID:       device.UDID,
+		labelOS:         device.OS,
+		labelImage:      spec.Image,
+		labelConfigHash: hash,
+	}
+	return spec, nil
+}
+
+// Get a short hash of the container definition to detect containers created from an outdated device definition
+func specHash(spec ContainerSpec) (string, error) {
+	spec.Labels = nil
+	bs, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// Get the UDID of the device a container belongs to, empty if it is not a device container of this provider
+func deviceUDIDFromLabels(labels map[string]string) string {
+	if labels[labelProvider] != providerID() {
+		return ""
+	}
+	return labels[labelUDID]
+}
+
+// Check if the container was created by a provider version that did not label the containers
+func isLegacyDeviceContainer(container ContainerInfo, udid string) bool {
+	if _, ok := container.Labels[labelUDID]; ok {
+		return false
+	}
+	return container.Name == "iosDevice_"+udid || container.Name == "androidDevice_"+udid
+}
+
+// Get the UDID of the device a provider container belongs to, empty for containers not managed by this provider
+// Unlabeled containers of older provider versions are only ours if they are named after a registered device,
+// other providers sharing the container host use the same names
+// Should be called with configMu held
+func containerDeviceUDID(container ContainerInfo) string {
+	if _, ok := container.Labels[labelUDID]; ok {
+		return deviceUDIDFromLabels(container.Labels)
+	}
+	for _, prefix := range []string{"iosDevice_", "androidDevice_"} {
+		if !strings.HasPrefix(container.Name, prefix) {
+			continue
+		}
+		udid := strings.TrimPrefix(container.Name, prefix)
+		if getDeviceByUDID(udid) != nil {
+			return udid
+		}
+	}
+	return ""
+}
@@ -0,0 +1,555 @@
+package device
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// State of the container of a device
+type LifecycleState string
+
+const (
+	StateAbsent     LifecycleState = "absent"
+	StateCreating   LifecycleState = "creating"
+	StateRunning    LifecycleState = "running"
+	StateRestarting LifecycleState = "restarting"
+	StateRemoving   LifecycleState = "removing"
+	StateFailed     LifecycleState = "failed"
+	// The container failed too often and is not restarted until the quarantine is cleared
+	StateQuarantined LifecycleState = "quarantined"
+)
+
+// Transition that brings the actual container state closer to the desired one
+type lifecycleAction string
+
+const (
+	actionNone    lifecycleAction = ""
+	actionCreate  lifecycleAction = "create"
+	actionRestart lifecycleAction = "restart"
+	actionRemove  lifecycleAction = "remove"
+	// Replace a container created from an outdated device definition
+	actionRecreate lifecycleAction = "recreate"
+	// Remove the container of a crash-looping device and keep it down
+	actionQuarantine lifecycleAction = "quarantine"
+)
+
+// Delay before creating an iOS container so the device is fully paired after connecting
+var iosCreateDelay = 2 * time.Second
+
+// Lifecycle of the container of a single device
+// Transitions of a device never overlap, a transition scheduled while another one is pending is dropped
+type deviceLifecycle struct {
+	// Held for the whole duration of a transition
+	transition sync.Mutex
+
+	mu        sync.Mutex
+	state     LifecycleState
+	scheduled bool
+	lastError string
+	// Incremented by synchronous transitions so scheduled transitions with a stale spec are skipped
+	generation int
+	// When the last transition finished, runtime events from before it are already handled by the transition
+	finishedAt time.Time
+
+	// Recent container failures, used for the restart backoff and the quarantine
+	failures    []time.Time
+	retryAt     time.Time
+	retryTimer  *time.Timer
+	quarantined bool
+	// Restarts and recreates of the container by the provider after a failure
+	restarts int
+}
+
+type lifecycleRegistry struct {
+	mu         sync.Mutex
+	lifecycles map[string]*deviceLifecycle
+}
+
+var lifecycles = &lifecycleRegistry{lifecycles: make(map[string]*deviceLifecycle)}
+
+// Get the lifecycle of a device, creating it if needed
+func (registry *lifecycleRegistry) get(udid string) *deviceLifecycle {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	lifecycle, ok := registry.lifecycles[udid]
+	if !ok {
+		lifecycle = &deviceLifecycle{state: StateAbsent}
+		registry.lifecycles[udid] = lifecycle
+	}
+	return lifecycle
+}
+
+// Forget the lifecycle of a device that is no longer registered
+func (registry *lifecycleRegistry) forget(udid string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if lifecycle, ok := registry.lifecycles[udid]; ok {
+		lifecycle.stopRetry()
+	}
+	delete(registry.lifecycles, udid)
+}
+
+func (lifecycle *deviceLifecycle) State() LifecycleState {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return lifecycle.state
+}
+
+// Mark a transition as scheduled, returns false if another transition is already pending
+func (lifecycle *deviceLifecycle) schedule(state LifecycleState) (int, bool) {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	if lifecycle.scheduled {
+		return 0, false
+	}
+	lifecycle.scheduled = true
+	lifecycle.state = state
+	return lifecycle.generation, true
+}
+
+func (lifecycle *deviceLifecycle) isScheduled() bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return lifecycle.scheduled
+}
+
+// Check if a scheduled transition is still current after waiting for the transition lock
+func (lifecycle *deviceLifecycle) current(generation int) bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	if lifecycle.generation != generation {
+		lifecycle.scheduled = false
+		return false
+	}
+	return true
+}
+
+// Record the result of a transition
+func (lifecycle *deviceLifecycle) finish(state LifecycleState, err error) {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	lifecycle.scheduled = false
+	lifecycle.state = state
+	lifecycle.finishedAt = time.Now()
+	lifecycle.lastError = ""
+	if err != nil {
+		lifecycle.lastError = err.Error()
+	}
+}
+
+// Check if a runtime event happened before the last transition finished
+// e.g. the die event of a container the provider already restarted or replaced
+func (lifecycle *deviceLifecycle) predates(timestamp int64) bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return timestamp > 0 && timestamp <= lifecycle.finishedAt.UnixMilli()
+}
+
+// Update the state from the actual container state when no transition is pending
+func (lifecycle *deviceLifecycle) observe(state LifecycleState) {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	if !lifecycle.scheduled {
+		lifecycle.state = state
+	}
+}
+
+// Take the transition lock for a synchronous transition, scheduled transitions that did not start yet are skipped
+func (lifecycle *deviceLifecycle) lockSync(state LifecycleState) {
+	lifecycle.mu.Lock()
+	lifecycle.generation++
+	lifecycle.mu.Unlock()
+
+	lifecycle.transition.Lock()
+
+	lifecycle.mu.Lock()
+	lifecycle.state = state
+	lifecycle.mu.Unlock()
+}
+
+// Decide which transition brings the container to the desired state
+// A connected device should have a running container and a disconnected device should not have a container
+func reconcileAction(connected bool, container *ContainerInfo) lifecycleAction {
+	if connected {
+		if container == nil {
+			return actionCreate
+		}
+		// No runtime restart policy is used, a container that is not running is only restarted by the provider
+		if container.State != "running" {
+			return actionRestart
+		}
+		return actionNone
+	}
+
+	if container != nil {
+		return actionRemove
+	}
+	return actionNone
+}
+
+// State of the device while the transition is running
+func (action lifecycleAction) pendingState() LifecycleState {
+	switch action {
+	case actionCreate, actionRecreate:
+		return StateCreating
+	case actionRestart:
+		return StateRestarting
+	case actionRemove:
+		return StateRemoving
+	case actionQuarantine:
+		return StateQuarantined
+	}
+	return StateAbsent
+}
+
+// State of the device after the transition
+func (action lifecycleAction) resultState(err error) LifecycleState {
+	// A quarantined device stays quarantined even if its container could not be removed
+	if action == actionQuarantine {
+		return StateQuarantined
+	}
+	if err != nil {
+		return StateFailed
+	}
+	if action == actionRemove {
+		return StateAbsent
+	}
+	return StateRunning
+}
+
+// A transition captured with everything it needs so it does not read the device while running
+type transition struct {
+	action      lifecycleAction
+	runtime     ContainerRuntime
+	spec        ContainerSpec
+	containerID string
+	failures    int
+}
+
+type transitionResult struct {
+	// ID of the affected container
+	containerID string
+	// The created container, nil if it could not be inspected
+	container  *ContainerInfo
+	quarantine *QuarantineInfo
+	err        error
+}
+
+// Execute a transition against the runtime
+func (t transition) perform() transitionResult {
+	ctx := context.Background()
+	result := transitionResult{containerID: t.containerID}
+	switch t.action {
+	case actionCreate:
+		if t.spec.OS == "ios" {
+			time.Sleep(iosCreateDelay)
+		}
+		result.containerID, result.err = createContainer(ctx, t.runtime, t.spec)
+		result.container = t.inspectCreated(ctx, result)
+	case actionRecreate:
+		result.err = removeContainer(ctx, t.runtime, t.containerID)
+		if result.err != nil {
+			return result
+		}
+		result.containerID, result.err = createContainer(ctx, t.runtime, t.spec)
+		result.container = t.inspectCreated(ctx, result)
+	case actionRestart:
+		result.err = t.runtime.Restart(ctx, t.containerID)
+	case actionRemove:
+		result.err = removeContainer(ctx, t.runtime, t.containerID)
+	case actionQuarantine:
+		result.quarantine, result.err = quarantineContainer(t.runtime, t.containerID, t.failures)
+	}
+	return result
+}
+
+// Inspect the created container so the device gets it without waiting for the next device update
+func (t transition) inspectCreated(ctx context.Context, result transitionResult) *ContainerInfo {
+	if result.err != nil {
+		return nil
+	}
+	container, err := t.runtime.Inspect(ctx, result.containerID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "container_inspect",
+		}).Error("Could not inspect created container with ID: " + result.containerID + ": " + err.Error())
+		return nil
+	}
+	return &container
+}
+
+// Schedule the transition that brings the device container to the desired state
+// Should be called with configMu held, the transition itself runs in the background
+func (device *Device) reconcileContainer(container *ContainerInfo) {
+	lifecycle := lifecycles.get(device.UDID)
+
+	action := reconcileAction(device.Connected, container)
+
+	// Replace the container if it was created from an outdated device definition
+	var spec ContainerSpec
+	if device.Connected && container != nil && !lifecycle.isQuarantined() {
+		var err error
+		spec, err = device.containerSpec()
+		if err == nil && container.Labels[labelConfigHash] != spec.Labels[labelConfigHash] {
+			action = actionRecreate
+		}
+	}
+
+	if action == actionNone {
+		if container != nil {
+			lifecycle.observe(StateRunning)
+		} else if lifecycle.isQuarantined() {
+			lifecycle.observe(StateQuarantined)
+		} else {
+			lifecycle.observe(StateAbsent)
+		}
+		return
+	}
+
+	// The pending transition will be followed by another reconcile
+	if lifecycle.isScheduled() {
+		return
+	}
+
+	// Everything read from the device is captured here so the transition does not race with device updates
+	t := transition{action: action, runtime: device.runtime()}
+	if container != nil {
+		t.containerID = container.ID
+		t.runtime = runtimeForContainer(container.ID)
+	}
+
+	if action == actionCreate || action == actionRestart {
+		if lifecycle.isQuarantined() {
+			lifecycle.observe(StateQuarantined)
+			return
+		}
+
+		// Wait for the backoff of the previous failures to expire
+		now := time.Now()
+		if retryAt := lifecycle.backoffUntil(); now.Before(retryAt) {
+			lifecycle.observe(StateFailed)
+			lifecycle.scheduleRetry(device, retryAt.Sub(now))
+			return
+		}
+
+		// A container that is not running has exited on its own
+		if action == actionRestart {
+			lifecycle.recordFailure(now)
+		}
+
+		t.failures = lifecycle.recentFailures(now)
+		if t.failures >= maxContainerFailures() {
+			t.action = actionQuarantine
+		}
+	}
+
+	if t.action == actionCreate || t.action == actionRecreate {
+		var err error
+		t.spec = spec
+		if t.action == actionCreate {
+			t.spec, err = device.containerSpec()
+		}
+		if err == nil {
+			err = device.createLogsDir()
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": device.OS + "_container_create",
+			}).Error("Could not prepare a container for device with udid: " + device.UDID + ": " + err.Error())
+			lifecycle.finish(StateFailed, err)
+			return
+		}
+	}
+
+	generation, ok := lifecycle.schedule(t.action.pendingState())
+	if !ok {
+		return
+	}
+	if t.action == actionQuarantine {
+		lifecycle.mu.Lock()
+		lifecycle.quarantined = true
+		lifecycle.mu.Unlock()
+	}
+
+	device.logTransitionStart(t.action, t.containerID)
+	go func() {
+		lifecycle.transition.Lock()
+		if !lifecycle.current(generation) {
+			lifecycle.transition.Unlock()
+			return
+		}
+		if t.action == actionRestart || (t.action == actionCreate && t.failures > 0) {
+			lifecycle.countRestart()
+		}
+		result := t.perform()
+		if result.err != nil && (t.action == actionCreate || t.action == actionRecreate) {
+			lifecycle.recordFailure(time.Now())
+		}
+		lifecycle.finish(t.action.resultState(result.err), result.err)
+		lifecycle.transition.Unlock()
+
+		configMu.Lock()
+		defer configMu.Unlock()
+		// Skip the device updates if the device was unregistered meanwhile
+		if getDeviceByUDID(device.UDID) != device {
+			return
+		}
+		device.applyTransition(t.action, result)
+
+		// Retry the failed create once its backoff expires
+		if result.err != nil && (t.action == actionCreate || t.action == actionRecreate) {
+			lifecycle.scheduleRetry(device, time.Until(lifecycle.backoffUntil()))
+		}
+	}()
+}
+
+// Remove the device container synchronously, waits for a running transition to finish first
+// Should be called with configMu held
+func (device *Device) removeExistingContainer() {
+	lifecycle := lifecycles.get(device.UDID)
+	lifecycle.lockSync(StateRemoving)
+	defer lifecycle.transition.Unlock()
+
+	allContainers, err := getHostContainers()
+	if err != nil {
+		lifecycle.finish(StateFailed, err)
+		return
+	}
+
+	container := device.findContainer(allContainers)
+	if container == nil {
+		lifecycle.finish(StateAbsent, nil)
+		return
+	}
+
+	device.logTransitionStart(actionRemove, container.ID)
+	err = removeContainer(context.Background(), runtimeForContainer(container.ID), container.ID)
+	lifecycle.finish(actionRemove.resultState(err), err)
+	device.applyTransition(actionRemove, transitionResult{containerID: container.ID, err: err})
+}
+
+// Attach the created container to the device and update the DB
+// If it could not be inspected only a container other than the created one is detached, it was replaced
+// Should be called with configMu held
+func (device *Device) setCreatedContainer(result transitionResult) {
+	if result.container != nil {
+		device.setContainer(*result.container)
+	} else if device.Container != nil && device.Container.ContainerID != result.containerID {
+		device.Container = nil
+	}
+	device.updateDB()
+}
+
+func (device *Device) logTransitionStart(action lifecycleAction, containerID string) {
+	switch action {
+	case actionCreate:
+		log.WithFields(log.Fields{
+			"event": device.OS + "_container_create",
+		}).Info("Attempting to create a container for " + device.OS + " device with udid: " + device.UDID)
+	case actionRestart:
+		log.WithFields(log.Fields{
+			"event": "container_restart",
+		}).Info("Attempting to restart container with ID: " + containerID)
+	case actionRemove:
+		log.WithFields(log.Fields{
+			"event": "container_remove",
+		}).Info("Attempting to remove container with ID: " + containerID)
+	case actionRecreate:
+		log.WithFields(log.Fields{
+			"event": device.OS + "_container_create",
+		}).Info("Recreating outdated container with ID: " + containerID + " for device with udid: " + device.UDID)
+	case actionQuarantine:
+		log.WithFields(log.Fields{
+			"event": "device_quarantine",
+		}).Warn("Quarantining device with udid: " + device.UDID + ", its container fails too often")
+	}
+}
+
+// Update the device, its events and the DB with the result of a transition
+// Should be called with configMu held
+func (device *Device) applyTransition(action lifecycleAction, result transitionResult) {
+	containerID := result.containerID
+	err := result.err
+	switch action {
+	case actionCreate:
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": device.OS + "_container_create",
+			}).Error("Could not create a container for device with udid: " + device.UDID + ": " + err.Error())
+			return
+		}
+		device.setCreatedContainer(result)
+		device.recordEvent(EventContainerCreated, "Created container with ID: "+containerID)
+		log.WithFields(log.Fields{
+			"event": device.OS + "_container_create",
+		}).Info("Successfully created a container for device with udid: " + device.UDID)
+	case actionRecreate:
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": device.OS + "_container_create",
+			}).Error("Could not recreate the container for device with udid: " + device.UDID + ": " + err.Error())
+			return
+		}
+		device.setCreatedContainer(result)
+		device.recordEvent(EventContainerCreated, "Recreated outdated container, new container ID: "+containerID)
+		log.WithFields(log.Fields{
+			"event": device.OS + "_container_create",
+		}).Info("Successfully recreated the container for device with udid: " + device.UDID)
+	case actionRestart:
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "container_restart",
+			}).Error("Could not restart container with ID: " + containerID + ": " + err.Error())
+			return
+		}
+		device.recordEvent(EventContainerRestarted, "Restarted container with ID: "+containerID)
+		log.WithFields(log.Fields{
+			"event": "container_restart",
+		}).Info("Successfully restarted container with ID: " + containerID)
+	case actionRemove:
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "container_remove",
+			}).Error("Could not remove container with ID: " + containerID + ": " + err.Error())
+			return
+		}
+		// Remove the container from the device pointer and update the DB
+		device.Container = nil
+		device.updateDB()
+		device.recordEvent(EventContainerRemoved, "Removed container with ID: "+containerID)
+		log.WithFields(log.Fields{
+			"event": "container_remove",
+		}).Info("Successfully removed container with ID: " + containerID)
+	case actionQuarantine:
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "device_quarantine",
+			}).Error("Could not remove container of quarantined device with udid: " + device.UDID + ": " + err.Error())
+		} else if containerID != "" {
+			device.Container = nil
+		}
+		device.Quarantine = result.quarantine
+		device.updateDB()
+		device.recordEvent(EventQuarantined, result.quarantine.Reason)
+	}
+}
+
+// Find the container of the device by its labels
+// Unlabeled containers created by older provider versions are matched by their exact name so they get recreated
+func (device *Device) findContainer(allContainers []ContainerInfo) *ContainerInfo {
+	for i, container := range allContainers {
+		if deviceUDIDFromLabels(container.Labels) == device.UDID || isLegacyDeviceContainer(container, device.UDID) {
+			return &allContainers[i]
+		}
+	}
+	return nil
+}
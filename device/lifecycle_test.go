@@ -0,0 +1,331 @@
+package device
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Point the provider globals to a fake runtime and an in-memory store
+// The tests run in a temporary folder since the device logs folders are created relative to it
+func setupFakeProvider(t *testing.T, devices ...*Device) *fakeRuntime {
+	t.Helper()
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempDir := t.TempDir()
+	err = os.Chdir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(workDir)
+	})
+
+	fake := newFakeRuntime()
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	projectDir = tempDir
+	containerRuntime = fake
+	nativeRuntimeInstance = newNativeRuntime()
+	store = newMemoryStore()
+	writer = &deviceWriter{devices: make(map[string]*writtenDevice)}
+	lifecycles = &lifecycleRegistry{lifecycles: make(map[string]*deviceLifecycle)}
+	ports = &portAllocator{}
+	Config = ConfigJsonData{
+		EnvConfig: EnvConfig{DevicesHost: "test-host"},
+		Devices:   devices,
+	}
+	for _, device := range devices {
+		device.Host = Config.EnvConfig.DevicesHost
+		device.insertDB()
+	}
+	return fake
+}
+
+func newTestDevice(udid string, connected bool) *Device {
+	return &Device{
+		UDID:                udid,
+		OS:                  "android",
+		Name:                "test_" + udid,
+		OSVersion:           "13",
+		ScreenSize:          "1080x2400",
+		Model:               "Pixel",
+		AppiumPort:          "4841",
+		StreamPort:          "20001",
+		ContainerServerPort: "20002",
+		Connected:           connected,
+	}
+}
+
+// Run the device update like the /dev watcher does
+func updateDevicesLocked() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	updateDevices()
+}
+
+// Wait until the number of recorded events of the type reaches the count
+// The events are recorded when the transition result is applied, so the transition goroutine is done after it
+func waitForEvents(t *testing.T, udid string, eventType string, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, err := store.ListEvents(EventFilter{UDID: udid, Type: eventType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == count {
+			return
+		}
+		if len(events) > count {
+			t.Fatalf("expected %d %s events for %s, got %d", count, eventType, udid, len(events))
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d %s events for %s, got %d", count, eventType, udid, len(events))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Check that the device points to the container
+func expectDeviceContainer(t *testing.T, device *Device, containerID string) {
+	t.Helper()
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if device.Container == nil || device.Container.ContainerID != containerID {
+		t.Errorf("expected the device container to be %s, got %+v", containerID, device.Container)
+	}
+}
+
+func listContainers(t *testing.T, runtime ContainerRuntime) []ContainerInfo {
+	t.Helper()
+
+	containers, err := runtime.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return containers
+}
+
+func TestReconcileAction(t *testing.T) {
+	tests := []struct {
+		name      string
+		connected bool
+		container *ContainerInfo
+		expected  lifecycleAction
+	}{
+		{"connected without container", true, nil, actionCreate},
+		{"connected with running container", true, &ContainerInfo{State: "running"}, actionNone},
+		{"connected with restarting container", true, &ContainerInfo{State: "restarting"}, actionRestart},
+		{"connected with exited container", true, &ContainerInfo{State: "exited"}, actionRestart},
+		{"connected with created container", true, &ContainerInfo{State: "created"}, actionRestart},
+		{"disconnected with container", false, &ContainerInfo{State: "running"}, actionRemove},
+		{"disconnected without container", false, nil, actionNone},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := reconcileAction(test.connected, test.container)
+			if action != test.expected {
+				t.Errorf("expected action %q, got %q", test.expected, action)
+			}
+		})
+	}
+}
+
+func TestReconcileContainerCreatesOneContainerOnConcurrentUpdates(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			updateDevicesLocked()
+		}()
+	}
+	wg.Wait()
+
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+
+	containers := listContainers(t, fake)
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container, got %d", len(containers))
+	}
+	if containers[0].State != "running" {
+		t.Errorf("expected the container to be running, got %s", containers[0].State)
+	}
+	if deviceUDIDFromLabels(containers[0].Labels) != device.UDID {
+		t.Errorf("expected the container to be labeled with %s, got %v", device.UDID, containers[0].Labels)
+	}
+	if state := lifecycles.get(device.UDID).State(); state != StateRunning {
+		t.Errorf("expected state %s, got %s", StateRunning, state)
+	}
+	expectDeviceContainer(t, device, containers[0].ID)
+}
+
+func TestReconcileContainerRemovesContainerOfDisconnectedDevice(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+
+	configMu.Lock()
+	device.Connected = false
+	configMu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			updateDevicesLocked()
+		}()
+	}
+	wg.Wait()
+
+	waitForEvents(t, device.UDID, EventContainerRemoved, 1)
+
+	if containers := listContainers(t, fake); len(containers) != 0 {
+		t.Fatalf("expected no containers, got %d", len(containers))
+	}
+	if state := lifecycles.get(device.UDID).State(); state != StateAbsent {
+		t.Errorf("expected state %s, got %s", StateAbsent, state)
+	}
+}
+
+func TestReconcileContainerRestartsExitedContainer(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+
+	containerID := listContainers(t, fake)[0].ID
+	err := fake.Stop(context.Background(), containerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerRestarted, 1)
+
+	containers := listContainers(t, fake)
+	if len(containers) != 1 || containers[0].ID != containerID || containers[0].State != "running" {
+		t.Fatalf("expected container %s to be running again, got %+v", containerID, containers)
+	}
+}
+
+func TestReconcileContainerRecreatesOutdatedContainer(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+	oldContainerID := listContainers(t, fake)[0].ID
+
+	configMu.Lock()
+	device.ScreenSize = "1440x3200"
+	configMu.Unlock()
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 2)
+
+	containers := listContainers(t, fake)
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container, got %d", len(containers))
+	}
+	if containers[0].ID == oldContainerID {
+		t.Errorf("expected the outdated container %s to be replaced", oldContainerID)
+	}
+	expectDeviceContainer(t, device, containers[0].ID)
+
+	configMu.Lock()
+	spec, err := device.containerSpec()
+	configMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containers[0].Labels[labelConfigHash] != spec.Labels[labelConfigHash] {
+		t.Errorf("expected the new container to have the config hash %s, got %s", spec.Labels[labelConfigHash], containers[0].Labels[labelConfigHash])
+	}
+}
+
+// The device readers, the DB writer and the health checks run concurrently with the device updates
+// and should only be caught by `go test -race` if they touch the devices without configMu
+func TestDeviceUpdatesConcurrentWithReaders(t *testing.T) {
+	// A closed port so the health checks fail right away
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().String()[strings.LastIndex(listener.Addr().String(), ":")+1:]
+	listener.Close()
+
+	device := newTestDevice("udid1", true)
+	device.AppiumPort = closedPort
+	device.ContainerServerPort = closedPort
+	setupFakeProvider(t, device)
+
+	// Keep reading and writing the device until all updates are done
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			GetConfigDevices()
+			GetDevice(device.UDID)
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			writer.flush(device.UDID)
+		}
+	}()
+
+	var updates sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		updates.Add(2)
+		go func() {
+			defer updates.Done()
+			updateDevicesLocked()
+		}()
+		go func() {
+			defer updates.Done()
+			configMu.Lock()
+			snapshot := device.clone()
+			configMu.Unlock()
+			device.updateHealthStatusDB(snapshot)
+		}()
+	}
+	updates.Wait()
+	close(done)
+	readers.Wait()
+
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+}
@@ -0,0 +1,84 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+var ErrNoContainer = errors.New("device has no container")
+
+// A single line of the container logs and the stream it was written to
+type LogLine struct {
+	// `stdout` or `stderr`
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// Splits the output written to one stream into lines
+type logLineWriter struct {
+	stream  string
+	partial []byte
+	handle  func(LogLine) error
+}
+
+func (writer *logLineWriter) Write(p []byte) (int, error) {
+	writer.partial = append(writer.partial, p...)
+	for {
+		index := bytes.IndexByte(writer.partial, '\n')
+		if index < 0 {
+			return len(p), nil
+		}
+
+		line := string(bytes.TrimSuffix(writer.partial[:index], []byte("\r")))
+		writer.partial = writer.partial[index+1:]
+		if err := writer.handle(LogLine{Stream: writer.stream, Line: line}); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Handle the last line if it did not end with a new line
+func (writer *logLineWriter) flush() error {
+	if len(writer.partial) == 0 {
+		return nil
+	}
+	line := string(writer.partial)
+	writer.partial = nil
+	return writer.handle(LogLine{Stream: writer.stream, Line: line})
+}
+
+// Demultiplex the container logs and call handle for each line in order
+// Returns when the logs end, the reader fails or handle returns an error
+func ReadLogLines(logs io.Reader, handle func(LogLine) error) error {
+	stdout := &logLineWriter{stream: "stdout", handle: handle}
+	stderr := &logLineWriter{stream: "stderr", handle: handle}
+
+	_, err := stdcopy.StdCopy(stdout, stderr, logs)
+	if err != nil {
+		return err
+	}
+
+	err = stdout.flush()
+	if err != nil {
+		return err
+	}
+	return stderr.flush()
+}
+
+// Get the ID of the container of a registered device
+func GetDeviceContainerID(udid string) (string, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	device := getDeviceByUDID(udid)
+	if device == nil {
+		return "", ErrDeviceNotFound
+	}
+	if device.Container == nil {
+		return "", ErrNoContainer
+	}
+	return device.Container.ContainerID, nil
+}
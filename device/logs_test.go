@@ -0,0 +1,138 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+func TestLogLineWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []string
+		expected []string
+	}{
+		{"single line", []string{"line\n"}, []string{"line"}},
+		{"multiple lines in a write", []string{"first\nsecond\n"}, []string{"first", "second"}},
+		{"line split across writes", []string{"fi", "rst\nsec", "ond\n"}, []string{"first", "second"}},
+		{"crlf is trimmed", []string{"first\r\n", "second\r", "\n"}, []string{"first", "second"}},
+		{"empty lines are kept", []string{"\n\nlast\n"}, []string{"", "", "last"}},
+		{"final unterminated line", []string{"first\nlast"}, []string{"first", "last"}},
+		{"no output", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lines []string
+			writer := &logLineWriter{stream: "stdout", handle: func(line LogLine) error {
+				if line.Stream != "stdout" {
+					t.Errorf("expected the stdout stream, got %s", line.Stream)
+				}
+				lines = append(lines, line.Line)
+				return nil
+			}}
+
+			for _, write := range test.writes {
+				n, err := writer.Write([]byte(write))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(write) {
+					t.Errorf("expected %d bytes to be written, got %d", len(write), n)
+				}
+			}
+			err := writer.flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(lines, test.expected) {
+				t.Errorf("expected lines %q, got %q", test.expected, lines)
+			}
+		})
+	}
+}
+
+// Multiplex the writes to the streams like the container runtime does
+func multiplexedLogs(t *testing.T, writes []LogLine) *bytes.Buffer {
+	t.Helper()
+
+	logs := &bytes.Buffer{}
+	stdout := stdcopy.NewStdWriter(logs, stdcopy.Stdout)
+	stderr := stdcopy.NewStdWriter(logs, stdcopy.Stderr)
+	for _, write := range writes {
+		var err error
+		if write.Stream == "stderr" {
+			_, err = stderr.Write([]byte(write.Line))
+		} else {
+			_, err = stdout.Write([]byte(write.Line))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return logs
+}
+
+func TestReadLogLines(t *testing.T) {
+	logs := multiplexedLogs(t, []LogLine{
+		{Stream: "stdout", Line: "starting\r\nAppium "},
+		{Stream: "stderr", Line: "warn"},
+		{Stream: "stdout", Line: "listening\n"},
+		{Stream: "stderr", Line: "ing\r\n"},
+		{Stream: "stdout", Line: "last stdout"},
+		{Stream: "stderr", Line: "last stderr"},
+	})
+
+	var lines []LogLine
+	err := ReadLogLines(logs, func(line LogLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []LogLine{
+		{Stream: "stdout", Line: "starting"},
+		{Stream: "stdout", Line: "Appium listening"},
+		{Stream: "stderr", Line: "warning"},
+		{Stream: "stdout", Line: "last stdout"},
+		{Stream: "stderr", Line: "last stderr"},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected lines %+v, got %+v", expected, lines)
+	}
+}
+
+func TestReadLogLinesStopsOnHandleError(t *testing.T) {
+	logs := multiplexedLogs(t, []LogLine{
+		{Stream: "stdout", Line: "first\n"},
+		{Stream: "stdout", Line: "second\n"},
+	})
+
+	handleErr := errors.New("client disconnected")
+	calls := 0
+	err := ReadLogLines(logs, func(line LogLine) error {
+		calls++
+		return handleErr
+	})
+	if !errors.Is(err, handleErr) {
+		t.Errorf("expected %v, got %v", handleErr, err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the lines to stop after the error, got %d calls", calls)
+	}
+}
+
+func TestReadLogLinesInvalidFrame(t *testing.T) {
+	err := ReadLogLines(bytes.NewBufferString("not a multiplexed stream\n"), func(line LogLine) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("expected an error for logs that are not multiplexed")
+	}
+}
@@ -0,0 +1,311 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const portsFilePath = "./configs/ports.json"
+
+// The host ports used by a device
+type DevicePorts struct {
+	AppiumPort          string `json:"appium_port,omitempty"`
+	StreamPort          string `json:"stream_port,omitempty"`
+	ContainerServerPort string `json:"container_server_port,omitempty"`
+	WDAPort             string `json:"wda_port,omitempty"`
+}
+
+// An inclusive range of host ports to allocate from
+type portRange struct {
+	start int
+	end   int
+}
+
+func (portRange portRange) contains(port string) bool {
+	portNumber, err := strconv.Atoi(port)
+	return err == nil && portNumber >= portRange.start && portNumber <= portRange.end
+}
+
+func (portRange portRange) String() string {
+	return strconv.Itoa(portRange.start) + "-" + strconv.Itoa(portRange.end)
+}
+
+var (
+	appiumPortRange          = portRange{4841, 4999}
+	wdaPortRange             = portRange{20001, 20100}
+	streamPortRange          = portRange{20101, 20200}
+	containerServerPortRange = portRange{20201, 20300}
+)
+
+// Assigns host ports per device UDID and persists them in ports.json
+// so they don't change when devices are added, removed or reordered in config.json
+type portAllocator struct {
+	mu          sync.Mutex
+	loaded      bool
+	allocations map[string]DevicePorts
+}
+
+var ports = &portAllocator{}
+
+// Get the ports of the device as a DevicePorts struct
+func (device *Device) ports() DevicePorts {
+	return DevicePorts{
+		AppiumPort:          device.AppiumPort,
+		StreamPort:          device.StreamPort,
+		ContainerServerPort: device.ContainerServerPort,
+		WDAPort:             device.WDAPort,
+	}
+}
+
+// Allocate the host ports for a device
+// Ports pinned in config.json win over the ports persisted for other registered devices, otherwise the ports
+// persisted for the UDID are reused if still free and new ports are allocated only for devices seen for the first time or when there is a collision
+func (device *Device) allocatePorts() error {
+	ports.mu.Lock()
+	defer ports.mu.Unlock()
+
+	err := ports.load()
+	if err != nil {
+		return err
+	}
+
+	// Collect the ports used by the other registered devices
+	usedPorts := make(map[string]string)
+	for _, registeredDevice := range Config.Devices {
+		if registeredDevice.UDID == device.UDID {
+			continue
+		}
+		for _, port := range []string{
+			registeredDevice.AppiumPort,
+			registeredDevice.StreamPort,
+			registeredDevice.ContainerServerPort,
+			registeredDevice.WDAPort,
+			registeredDevice.pinnedPorts.AppiumPort,
+			registeredDevice.pinnedPorts.StreamPort,
+			registeredDevice.pinnedPorts.ContainerServerPort,
+			registeredDevice.pinnedPorts.WDAPort,
+		} {
+			if port != "" {
+				usedPorts[port] = registeredDevice.UDID
+			}
+		}
+	}
+
+	// Collect the ports reserved for other UDIDs so devices that are not allocated yet on startup get their ports back
+	// The allocations of unregistered devices are released, so only devices removed from config.json while the provider was stopped keep theirs
+	reservedPorts := make(map[string]string)
+	for udid, allocation := range ports.allocations {
+		if udid == device.UDID {
+			continue
+		}
+		for _, port := range []string{allocation.AppiumPort, allocation.StreamPort, allocation.ContainerServerPort, allocation.WDAPort} {
+			if port != "" {
+				reservedPorts[port] = udid
+			}
+		}
+	}
+
+	previous := ports.allocations[device.UDID]
+	var allocation DevicePorts
+
+	allocation.AppiumPort, err = pickPort(device.pinnedPorts.AppiumPort, previous.AppiumPort, appiumPortRange, usedPorts, reservedPorts, device.UDID)
+	if err != nil {
+		return err
+	}
+	usedPorts[allocation.AppiumPort] = device.UDID
+
+	allocation.StreamPort, err = pickPort(device.pinnedPorts.StreamPort, previous.StreamPort, streamPortRange, usedPorts, reservedPorts, device.UDID)
+	if err != nil {
+		return err
+	}
+	usedPorts[allocation.StreamPort] = device.UDID
+
+	allocation.ContainerServerPort, err = pickPort(device.pinnedPorts.ContainerServerPort, previous.ContainerServerPort, containerServerPortRange, usedPorts, reservedPorts, device.UDID)
+	if err != nil {
+		return err
+	}
+	usedPorts[allocation.ContainerServerPort] = device.UDID
+
+	if device.OS == "ios" {
+		allocation.WDAPort, err = pickPort(device.pinnedPorts.WDAPort, previous.WDAPort, wdaPortRange, usedPorts, reservedPorts, device.UDID)
+		if err != nil {
+			return err
+		}
+	}
+
+	device.AppiumPort = allocation.AppiumPort
+	device.StreamPort = allocation.StreamPort
+	device.ContainerServerPort = allocation.ContainerServerPort
+	device.WDAPort = allocation.WDAPort
+
+	if allocation != previous {
+		ports.allocations[device.UDID] = allocation
+		err = ports.save()
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"event": "port_allocation",
+		}).Info("Allocated ports for device " + device.UDID + ": appium " + allocation.AppiumPort + ", stream " + allocation.StreamPort + ", container server " + allocation.ContainerServerPort + ", wda " + allocation.WDAPort)
+	}
+
+	return nil
+}
+
+// Pick a single port for a device - the pinned one, the previously allocated one or a new free port from the range
+// A pinned port can take over a port reserved for another registered device since that device moves to a new port
+func pickPort(pinned string, previous string, portRange portRange, usedPorts map[string]string, reservedPorts map[string]string, udid string) (string, error) {
+	if pinned != "" {
+		if !portRange.contains(pinned) {
+			return "", errors.New("Pinned port " + pinned + " of device " + udid + " is outside the range " + portRange.String())
+		}
+		if otherUDID, ok := usedPorts[pinned]; ok {
+			return "", errors.New("Pinned port " + pinned + " of device " + udid + " is already used by device " + otherUDID)
+		}
+		if otherUDID, ok := reservedPorts[pinned]; ok && getDeviceByUDID(otherUDID) == nil {
+			return "", errors.New("Pinned port " + pinned + " of device " + udid + " is reserved for device " + otherUDID + " in ports.json")
+		}
+		return pinned, nil
+	}
+
+	// Keep the previous port even if it is bound on the host
+	// because it is most likely bound by the device's own running container
+	if previous != "" {
+		_, used := usedPorts[previous]
+		_, reserved := reservedPorts[previous]
+		if !used && !reserved {
+			return previous, nil
+		}
+	}
+
+	for port := portRange.start; port <= portRange.end; port++ {
+		candidate := strconv.Itoa(port)
+		if _, ok := usedPorts[candidate]; ok {
+			continue
+		}
+		if _, ok := reservedPorts[candidate]; ok || portBoundOnHost(candidate) {
+			continue
+		}
+		return candidate, nil
+	}
+
+	return "", errors.New("No free port left in range " + portRange.String() + " for device " + udid)
+}
+
+// Release the ports of an unregistered device so they can be allocated to other devices
+func (device *Device) releasePorts() error {
+	ports.mu.Lock()
+	defer ports.mu.Unlock()
+
+	err := ports.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := ports.allocations[device.UDID]; !ok {
+		return nil
+	}
+
+	delete(ports.allocations, device.UDID)
+	return ports.save()
+}
+
+// Check if a port is already bound by another process on the host
+func portBoundOnHost(port string) bool {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return true
+	}
+	listener.Close()
+	return false
+}
+
+// Read the persisted port allocations from ports.json once
+func (allocator *portAllocator) load() error {
+	if allocator.loaded {
+		return nil
+	}
+
+	allocator.allocations = make(map[string]DevicePorts)
+	bs, err := ioutil.ReadFile(portsFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			allocator.loaded = true
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"event": "port_allocation",
+		}).Error("Could not read ports.json: " + err.Error())
+		return err
+	}
+
+	err = json.Unmarshal(bs, &allocator.allocations)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "port_allocation",
+		}).Error("Could not unmarshal ports.json: " + err.Error())
+		return err
+	}
+
+	allocator.loaded = true
+	return nil
+}
+
+// Persist the port allocations to ports.json atomically
+func (allocator *portAllocator) save() error {
+	bs, err := json.MarshalIndent(allocator.allocations, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(portsFilePath, bs)
+}
+
+// Write a file by writing to a temporary file in the same folder and renaming it
+// so readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	// Keep the permissions of the existing file if there is one
+	var fileMode os.FileMode = 0644
+	fileInfo, err := os.Stat(path)
+	if err == nil {
+		fileMode = fileInfo.Mode().Perm()
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = tmpFile.Chmod(fileMode)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
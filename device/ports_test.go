@@ -0,0 +1,193 @@
+package device
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Allocate the ports of the devices in the order of config.json like on startup
+func allocateConfigPorts(t *testing.T, devices []*Device) {
+	t.Helper()
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	Config.Devices = devices
+	for _, device := range devices {
+		err := device.allocatePorts()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newPortsTestDevice(udid string, deviceOS string) *Device {
+	return &Device{UDID: udid, OS: deviceOS}
+}
+
+func setupPortsTest(t *testing.T) {
+	t.Helper()
+
+	setupFakeProvider(t)
+	err := os.Mkdir("configs", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocatePortsIsStableWhenDevicesAreReordered(t *testing.T) {
+	setupPortsTest(t)
+
+	devices := []*Device{
+		newPortsTestDevice("udid1", "android"),
+		newPortsTestDevice("udid2", "ios"),
+		newPortsTestDevice("udid3", "android"),
+	}
+	allocateConfigPorts(t, devices)
+
+	allocated := make(map[string]DevicePorts)
+	for _, device := range devices {
+		allocated[device.UDID] = device.ports()
+	}
+
+	// A provider restart with a new device inserted at the top and the other devices reordered
+	ports = &portAllocator{}
+	reordered := []*Device{
+		newPortsTestDevice("udid4", "ios"),
+		newPortsTestDevice("udid3", "android"),
+		newPortsTestDevice("udid1", "android"),
+		newPortsTestDevice("udid2", "ios"),
+	}
+	allocateConfigPorts(t, reordered)
+
+	for _, device := range reordered[1:] {
+		if device.ports() != allocated[device.UDID] {
+			t.Errorf("expected device %s to keep ports %+v, got %+v", device.UDID, allocated[device.UDID], device.ports())
+		}
+	}
+	if reordered[0].WDAPort == allocated["udid2"].WDAPort {
+		t.Errorf("expected the new device to get a free WDA port, got %s", reordered[0].WDAPort)
+	}
+	for _, device := range reordered[1:] {
+		if reordered[0].AppiumPort == device.AppiumPort {
+			t.Errorf("expected the new device to get a free Appium port, got %s", reordered[0].AppiumPort)
+		}
+	}
+}
+
+func TestAllocatePortsReleasesPortsOfUnregisteredDevice(t *testing.T) {
+	setupPortsTest(t)
+
+	device := newPortsTestDevice("udid1", "android")
+	allocateConfigPorts(t, []*Device{device})
+	released := device.AppiumPort
+
+	err := device.releasePorts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The released port is available to other devices, also after a restart
+	ports = &portAllocator{}
+	otherDevice := newPortsTestDevice("udid2", "android")
+	allocateConfigPorts(t, []*Device{otherDevice})
+	if otherDevice.AppiumPort != released {
+		t.Errorf("expected the released port %s to be allocated again, got %s", released, otherDevice.AppiumPort)
+	}
+}
+
+func TestAllocatePortsConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		// Device allocated before, then removed from config.json without releasing its ports
+		reserved *Device
+		// Devices in config.json, one of them is expected to fail
+		devices []*Device
+		err     string
+	}{
+		{
+			name: "pinned port used by another device",
+			devices: []*Device{
+				{UDID: "udid1", OS: "android", pinnedPorts: DevicePorts{AppiumPort: "4850"}},
+				{UDID: "udid2", OS: "android", pinnedPorts: DevicePorts{AppiumPort: "4850"}},
+			},
+			err: "Pinned port 4850 of device udid1 is already used by device udid2",
+		},
+		{
+			name: "pinned port outside the range",
+			devices: []*Device{
+				{UDID: "udid1", OS: "android", pinnedPorts: DevicePorts{StreamPort: "4850"}},
+			},
+			err: "Pinned port 4850 of device udid1 is outside the range 20101-20200",
+		},
+		{
+			name:     "pinned port reserved for a removed device",
+			reserved: &Device{UDID: "udid1", OS: "android", pinnedPorts: DevicePorts{AppiumPort: "4850"}},
+			devices: []*Device{
+				{UDID: "udid2", OS: "android", pinnedPorts: DevicePorts{AppiumPort: "4850"}},
+			},
+			err: "Pinned port 4850 of device udid2 is reserved for device udid1 in ports.json",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupPortsTest(t)
+			if test.reserved != nil {
+				allocateConfigPorts(t, []*Device{test.reserved})
+			}
+
+			configMu.Lock()
+			defer configMu.Unlock()
+			Config.Devices = test.devices
+			var err error
+			for _, device := range test.devices {
+				err = device.allocatePorts()
+				if err != nil {
+					break
+				}
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestAllocatePortsPinnedPortMovesRegisteredDevice(t *testing.T) {
+	setupPortsTest(t)
+
+	device := newPortsTestDevice("udid1", "android")
+	allocateConfigPorts(t, []*Device{device})
+	previousPort := device.AppiumPort
+
+	// Another device pins the port of udid1 in config.json
+	ports = &portAllocator{}
+	pinnedDevice := &Device{UDID: "udid2", OS: "android", pinnedPorts: DevicePorts{AppiumPort: previousPort}}
+	device = newPortsTestDevice("udid1", "android")
+	allocateConfigPorts(t, []*Device{pinnedDevice, device})
+
+	if pinnedDevice.AppiumPort != previousPort {
+		t.Errorf("expected the pinned port %s, got %s", previousPort, pinnedDevice.AppiumPort)
+	}
+	if device.AppiumPort == previousPort {
+		t.Errorf("expected device udid1 to move from the pinned port %s", previousPort)
+	}
+}
+
+func TestPickPortExhaustion(t *testing.T) {
+	portRange := portRange{5001, 5003}
+	usedPorts := map[string]string{"5001": "udid1", "5002": "udid2"}
+	reservedPorts := map[string]string{"5003": "udid3"}
+
+	_, err := pickPort("", "", portRange, usedPorts, reservedPorts, "udid4")
+	if err == nil || !strings.HasPrefix(err.Error(), "No free port left in range 5001-5003") {
+		t.Errorf("expected the range to be exhausted, got %v", err)
+	}
+
+	// The previous port is not reused if it is reserved for another device
+	_, err = pickPort("", "5003", portRange, usedPorts, reservedPorts, "udid4")
+	if err == nil {
+		t.Error("expected the reserved previous port not to be reused")
+	}
+}
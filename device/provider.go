@@ -0,0 +1,37 @@
+package device
+
+// The state of the provider and its dependencies
+type ProviderStatus struct {
+	DevicesHost       string      `json:"devices_host"`
+	RegisteredDevices int         `json:"registered_devices"`
+	ConnectedDevices  int         `json:"connected_devices"`
+	ContainerRuntime  string      `json:"container_runtime"`
+	Store             StoreStatus `json:"store"`
+}
+
+// Get the current provider status
+func GetProviderStatus() ProviderStatus {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	status := ProviderStatus{
+		DevicesHost:       Config.EnvConfig.DevicesHost,
+		RegisteredDevices: len(Config.Devices),
+	}
+
+	for _, device := range Config.Devices {
+		if device.Connected {
+			status.ConnectedDevices++
+		}
+	}
+
+	if containerRuntime != nil {
+		status.ContainerRuntime = containerRuntime.Name()
+	}
+
+	if store != nil {
+		status.Store = store.Status()
+	}
+
+	return status
+}
@@ -0,0 +1,225 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Why a device was quarantined, attached to the device so it is visible in the hub
+type QuarantineInfo struct {
+	Reason string `json:"reason"`
+	// Unix timestamp in milliseconds
+	Since    int64 `json:"since"`
+	Failures int   `json:"failures"`
+	// The last lines of the container logs before it was removed
+	Logs string `json:"logs,omitempty"`
+}
+
+const (
+	defaultMaxContainerFailures      = 5
+	defaultContainerFailureWindowSec = 600
+	minRestartBackoff                = 5 * time.Second
+	maxRestartBackoff                = 5 * time.Minute
+	quarantineLogsTail               = "100"
+)
+
+var ErrDeviceNotQuarantined = errors.New("device is not quarantined")
+
+// Number of container failures in the failure window after which a device is quarantined
+func maxContainerFailures() int {
+	if Config.EnvConfig.MaxContainerFailures > 0 {
+		return Config.EnvConfig.MaxContainerFailures
+	}
+	return defaultMaxContainerFailures
+}
+
+func containerFailureWindow() time.Duration {
+	if Config.EnvConfig.ContainerFailureWindowSec > 0 {
+		return time.Duration(Config.EnvConfig.ContainerFailureWindowSec) * time.Second
+	}
+	return defaultContainerFailureWindowSec * time.Second
+}
+
+// Delay before the next container create or restart after the provided number of recent failures
+func restartBackoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+
+	backoff := minRestartBackoff
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= maxRestartBackoff {
+			return maxRestartBackoff
+		}
+	}
+	return backoff
+}
+
+// Record a container failure, returns the number of failures in the window
+// The next create or restart is delayed by the backoff for that number of failures
+func (lifecycle *deviceLifecycle) recordFailure(now time.Time) int {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	lifecycle.failures = append(lifecycle.recentFailuresLocked(now), now)
+	lifecycle.retryAt = now.Add(restartBackoff(len(lifecycle.failures)))
+	return len(lifecycle.failures)
+}
+
+// Get the failures that are still in the failure window
+func (lifecycle *deviceLifecycle) recentFailuresLocked(now time.Time) []time.Time {
+	windowStart := now.Add(-containerFailureWindow())
+	var recent []time.Time
+	for _, failure := range lifecycle.failures {
+		if failure.After(windowStart) {
+			recent = append(recent, failure)
+		}
+	}
+	return recent
+}
+
+func (lifecycle *deviceLifecycle) recentFailures(now time.Time) int {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	lifecycle.failures = lifecycle.recentFailuresLocked(now)
+	return len(lifecycle.failures)
+}
+
+func (lifecycle *deviceLifecycle) countRestart() {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	lifecycle.restarts++
+}
+
+// Number of times the provider restarted or recreated the container after a failure
+// Reported as the restart count of the device since no runtime restart policy is used
+func (lifecycle *deviceLifecycle) RestartCount() int {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return lifecycle.restarts
+}
+
+// Get the time until which creates and restarts are delayed
+func (lifecycle *deviceLifecycle) backoffUntil() time.Time {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return lifecycle.retryAt
+}
+
+func (lifecycle *deviceLifecycle) isQuarantined() bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return lifecycle.quarantined
+}
+
+// Reconcile the device again when its backoff expires, only one retry is kept per device
+func (lifecycle *deviceLifecycle) scheduleRetry(device *Device, delay time.Duration) {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	if lifecycle.retryTimer != nil {
+		return
+	}
+	lifecycle.retryTimer = time.AfterFunc(delay, func() {
+		lifecycle.mu.Lock()
+		lifecycle.retryTimer = nil
+		lifecycle.mu.Unlock()
+
+		configMu.Lock()
+		defer configMu.Unlock()
+		if getDeviceByUDID(device.UDID) == device {
+			updateDevicesContainers([]*Device{device})
+		}
+	})
+}
+
+func (lifecycle *deviceLifecycle) stopRetry() {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+
+	if lifecycle.retryTimer != nil {
+		lifecycle.retryTimer.Stop()
+		lifecycle.retryTimer = nil
+	}
+}
+
+// Get the last lines of the container logs to attach them to the quarantine
+func quarantineLogs(runtime ContainerRuntime, containerID string) string {
+	if containerID == "" {
+		return ""
+	}
+
+	out, err := runtime.Logs(context.Background(), containerID, LogOptions{Stdout: true, Stderr: true, Tail: quarantineLogsTail})
+	if err != nil {
+		return "Could not get container logs: " + err.Error()
+	}
+	defer out.Close()
+
+	var logs strings.Builder
+	err = ReadLogLines(out, func(line LogLine) error {
+		logs.WriteString(line.Line + "\n")
+		return nil
+	})
+	if err != nil {
+		return "Could not read container logs: " + err.Error()
+	}
+	return logs.String()
+}
+
+// Stop the device container and keep the logs, the device is not restarted until the quarantine is cleared
+func quarantineContainer(runtime ContainerRuntime, containerID string, failures int) (*QuarantineInfo, error) {
+	quarantine := &QuarantineInfo{
+		Reason:   "Container failed " + strconv.Itoa(failures) + " times in the last " + containerFailureWindow().String(),
+		Since:    time.Now().UnixMilli(),
+		Failures: failures,
+		Logs:     quarantineLogs(runtime, containerID),
+	}
+
+	if containerID == "" {
+		return quarantine, nil
+	}
+	return quarantine, removeContainer(context.Background(), runtime, containerID)
+}
+
+// Clear the quarantine of a device and reconcile its container again
+func ClearQuarantine(udid string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	device := getDeviceByUDID(udid)
+	if device == nil {
+		return ErrDeviceNotFound
+	}
+
+	lifecycle := lifecycles.get(udid)
+	lifecycle.mu.Lock()
+	quarantined := lifecycle.quarantined
+	lifecycle.quarantined = false
+	lifecycle.failures = nil
+	lifecycle.retryAt = time.Time{}
+	if quarantined {
+		lifecycle.state = StateAbsent
+	}
+	lifecycle.mu.Unlock()
+
+	if !quarantined && device.Quarantine == nil {
+		return ErrDeviceNotQuarantined
+	}
+
+	device.Quarantine = nil
+	device.updateDB()
+	device.recordEvent(EventQuarantineCleared, "")
+	log.WithFields(log.Fields{
+		"event": "device_quarantine",
+	}).Info("Cleared quarantine of device with udid: " + udid)
+
+	updateDevicesContainers([]*Device{device})
+	return nil
+}
@@ -0,0 +1,171 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{4, 40 * time.Second},
+		{6, 160 * time.Second},
+		{7, 5 * time.Minute},
+		{20, 5 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if backoff := restartBackoff(test.failures); backoff != test.expected {
+			t.Errorf("expected a backoff of %s after %d failures, got %s", test.expected, test.failures, backoff)
+		}
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		// How long ago the previous failures happened
+		previous []time.Duration
+		expected int
+	}{
+		{"first failure", nil, 1},
+		{"failures in the window", []time.Duration{time.Minute, 5 * time.Minute}, 3},
+		{"failures outside the window are dropped", []time.Duration{11 * time.Minute, 20 * time.Minute}, 1},
+		{"only failures in the window are counted", []time.Duration{time.Minute, 11 * time.Minute}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupFakeProvider(t)
+
+			lifecycle := &deviceLifecycle{}
+			for _, ago := range test.previous {
+				lifecycle.failures = append(lifecycle.failures, now.Add(-ago))
+			}
+
+			failures := lifecycle.recordFailure(now)
+			if failures != test.expected {
+				t.Errorf("expected %d failures in the window, got %d", test.expected, failures)
+			}
+			if retryAt := lifecycle.backoffUntil(); !retryAt.Equal(now.Add(restartBackoff(test.expected))) {
+				t.Errorf("expected the backoff to last until %s, got %s", now.Add(restartBackoff(test.expected)), retryAt)
+			}
+		})
+	}
+}
+
+func TestReconcileContainerRetriesAfterBackoff(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	lifecycle := lifecycles.get(device.UDID)
+	lifecycle.mu.Lock()
+	lifecycle.failures = []time.Time{time.Now()}
+	lifecycle.retryAt = time.Now().Add(200 * time.Millisecond)
+	lifecycle.mu.Unlock()
+
+	updateDevicesLocked()
+	if containers := listContainers(t, fake); len(containers) != 0 {
+		t.Fatalf("expected no container to be created during the backoff, got %d", len(containers))
+	}
+	if state := lifecycle.State(); state != StateFailed {
+		t.Errorf("expected state %s during the backoff, got %s", StateFailed, state)
+	}
+
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+	if restarts := lifecycle.RestartCount(); restarts != 1 {
+		t.Errorf("expected the retried create to be counted as a restart, got %d", restarts)
+	}
+}
+
+func TestReconcileContainerQuarantinesAfterMaxFailures(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+	configMu.Lock()
+	Config.EnvConfig.MaxContainerFailures = 3
+	configMu.Unlock()
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+
+	// Two failures below the threshold are restarted
+	lifecycle := lifecycles.get(device.UDID)
+	for i := 1; i <= 2; i++ {
+		err := fake.Stop(context.Background(), listContainers(t, fake)[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updateDevicesLocked()
+		waitForEvents(t, device.UDID, EventContainerRestarted, i)
+
+		// Skip the backoff of the failure
+		lifecycle.mu.Lock()
+		lifecycle.retryAt = time.Time{}
+		lifecycle.mu.Unlock()
+	}
+	if restarts := lifecycle.RestartCount(); restarts != 2 {
+		t.Errorf("expected 2 restarts, got %d", restarts)
+	}
+
+	// The third failure reaches the threshold
+	err := fake.Stop(context.Background(), listContainers(t, fake)[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventQuarantined, 1)
+
+	if containers := listContainers(t, fake); len(containers) != 0 {
+		t.Fatalf("expected the container of the quarantined device to be removed, got %d", len(containers))
+	}
+	configMu.Lock()
+	quarantine := device.Quarantine
+	configMu.Unlock()
+	if quarantine == nil || quarantine.Failures != 3 {
+		t.Fatalf("expected the device to be quarantined after 3 failures, got %+v", quarantine)
+	}
+	if state := lifecycle.State(); state != StateQuarantined {
+		t.Errorf("expected state %s, got %s", StateQuarantined, state)
+	}
+
+	// A quarantined device does not get a new container
+	updateDevicesLocked()
+	if containers := listContainers(t, fake); len(containers) != 0 {
+		t.Fatalf("expected no container for the quarantined device, got %d", len(containers))
+	}
+
+	err = ClearQuarantine(device.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEvents(t, device.UDID, EventQuarantineCleared, 1)
+	waitForEvents(t, device.UDID, EventContainerCreated, 2)
+
+	configMu.Lock()
+	quarantine = device.Quarantine
+	configMu.Unlock()
+	if quarantine != nil {
+		t.Errorf("expected the quarantine to be cleared, got %+v", quarantine)
+	}
+	if failures := lifecycle.recentFailures(time.Now()); failures != 0 {
+		t.Errorf("expected the failures to be cleared, got %d", failures)
+	}
+
+	err = ClearQuarantine(device.UDID)
+	if !errors.Is(err, ErrDeviceNotQuarantined) {
+		t.Errorf("expected %v, got %v", ErrDeviceNotQuarantined, err)
+	}
+	err = ClearQuarantine("unknown")
+	if !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("expected %v, got %v", ErrDeviceNotFound, err)
+	}
+}
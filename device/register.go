@@ -0,0 +1,146 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrDeviceExists   = errors.New("device is already registered")
+	ErrDeviceNotFound = errors.New("device is not registered")
+	ErrInvalidDevice  = errors.New("invalid device")
+)
+
+// Register a new device at runtime
+// The device is persisted to config.json, inserted in the DB and its container is created if it is connected
+// Nothing is applied if config.json cannot be written
+func RegisterDevice(newDevice *Device) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	err := newDevice.validate()
+	if err != nil {
+		return err
+	}
+
+	if getDeviceByUDID(newDevice.UDID) != nil {
+		return ErrDeviceExists
+	}
+
+	device := newDevice.configEntry()
+	device.pinnedPorts = newDevice.ports()
+
+	newDevices := append(append([]*Device{}, Config.Devices...), device)
+	err = saveConfigDevices(newDevices)
+	if err != nil {
+		return err
+	}
+
+	Config.Devices = newDevices
+	err = device.register()
+	if err != nil {
+		// Revert the config.json change so the device is not registered on the next start either
+		Config.Devices = removeDevice(Config.Devices, device)
+		revertErr := saveConfigJsonData()
+		if revertErr != nil {
+			log.WithFields(log.Fields{
+				"event": "register_device",
+			}).Error("Could not remove device " + device.UDID + " from config.json after a failed registration: " + revertErr.Error())
+		}
+		return err
+	}
+
+	regenerateUdevRules()
+	updateDevicesContainers([]*Device{device})
+
+	return nil
+}
+
+// Update the config.json fields of a registered device at runtime
+// The device container is recreated only if its configuration actually changed
+// Nothing is applied if config.json cannot be written
+func UpdateRegisteredDevice(newDevice *Device) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	err := newDevice.validate()
+	if err != nil {
+		return err
+	}
+
+	device := getDeviceByUDID(newDevice.UDID)
+	if device == nil {
+		return ErrDeviceNotFound
+	}
+
+	updatedDevice := newDevice.configEntry()
+	updatedDevice.pinnedPorts = newDevice.ports()
+	if device.configEqual(updatedDevice) {
+		return nil
+	}
+
+	var newDevices []*Device
+	for _, registeredDevice := range Config.Devices {
+		if registeredDevice == device {
+			registeredDevice = updatedDevice
+		}
+		newDevices = append(newDevices, registeredDevice)
+	}
+	err = saveConfigDevices(newDevices)
+	if err != nil {
+		return err
+	}
+
+	device.reconfigure(updatedDevice)
+	regenerateUdevRules()
+	updateDevicesContainers([]*Device{device})
+
+	return nil
+}
+
+// Unregister a device at runtime, removing its container, DB document and config.json entry
+// Nothing is applied if config.json cannot be written
+func UnregisterDevice(udid string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	device := getDeviceByUDID(udid)
+	if device == nil {
+		return ErrDeviceNotFound
+	}
+
+	newDevices := removeDevice(Config.Devices, device)
+	err := saveConfigDevices(newDevices)
+	if err != nil {
+		return err
+	}
+
+	device.unregister()
+	Config.Devices = newDevices
+	regenerateUdevRules()
+
+	return nil
+}
+
+// Regenerate the udev rules after the registered devices changed
+func regenerateUdevRules() {
+	// The rules still have to be copied to /etc/udev/rules.d/ for new devices to get a symlink in /dev
+	err := createUdevRules()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "create_udev_rules",
+		}).Warn("Could not regenerate udev rules after devices change: " + err.Error())
+	}
+}
+
+// Check that the device has all the fields needed to create its container
+func (device *Device) validate() error {
+	problems := device.validateFields("$")
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidDevice, (&ConfigValidationError{Problems: problems}).Error())
+	}
+
+	return nil
+}
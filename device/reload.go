@@ -0,0 +1,312 @@
+package device
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Devices that differ between the running config and a newly read config.json
+type configDiff struct {
+	added   []*Device
+	removed []*Device
+	// Running device pointers mapped to their new config.json entries
+	changed map[*Device]*Device
+}
+
+// Re-read config.json and apply only the devices-config and container-config changes to the running provider
+// Unchanged devices keep their containers, ports and Appium sessions
+func ReloadConfig() error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	newConfig, err := readConfigJsonData()
+	if err != nil {
+		return err
+	}
+
+	if newConfig.AppiumConfig != Config.AppiumConfig || newConfig.EnvConfig != Config.EnvConfig || !reflect.DeepEqual(newConfig.NativeConfig, Config.NativeConfig) {
+		log.WithFields(log.Fields{
+			"event": "config_reload",
+		}).Warn("Changes to appium-config, env-config and native-config require a provider restart, only devices-config changes will be applied")
+	}
+
+	// The exec allowlist is only read when running commands so it can be applied right away
+	Config.ExecConfig = newConfig.ExecConfig
+
+	// Containers created with the previous OS overrides are recreated because their config hash changes
+	containerConfigChanged := !reflect.DeepEqual(newConfig.ContainerConfig, Config.ContainerConfig)
+	Config.ContainerConfig = newConfig.ContainerConfig
+
+	diff := diffConfigDevices(Config.Devices, newConfig.Devices)
+	if len(diff.added) == 0 && len(diff.removed) == 0 && len(diff.changed) == 0 && !containerConfigChanged {
+		log.WithFields(log.Fields{
+			"event": "config_reload",
+		}).Info("No device changes found in config.json")
+		return nil
+	}
+
+	// Remove the containers and DB documents of devices that are no longer in config.json
+	for _, device := range diff.removed {
+		device.unregister()
+	}
+
+	// Update the changed devices in place and remove their containers so they are recreated
+	for device, newDevice := range diff.changed {
+		device.reconfigure(newDevice)
+	}
+
+	// Build the new devices list in config.json order reusing the running device pointers
+	currentDevices := make(map[string]*Device)
+	for _, device := range Config.Devices {
+		currentDevices[device.UDID] = device
+	}
+	var devices []*Device
+	for _, newDevice := range newConfig.Devices {
+		if device, ok := currentDevices[newDevice.UDID]; ok {
+			devices = append(devices, device)
+			continue
+		}
+		devices = append(devices, newDevice)
+	}
+	Config.Devices = devices
+
+	// Set up the newly added devices
+	var updatedDevices []*Device
+	for _, device := range diff.added {
+		err = device.register()
+		if err != nil {
+			Config.Devices = removeDevice(Config.Devices, device)
+			continue
+		}
+		updatedDevices = append(updatedDevices, device)
+	}
+	for device := range diff.changed {
+		updatedDevices = append(updatedDevices, device)
+	}
+
+	// Create containers only for the added and changed devices, or for all devices if the OS overrides changed
+	if containerConfigChanged {
+		updatedDevices = Config.Devices
+	}
+	updateDevicesContainers(updatedDevices)
+
+	return nil
+}
+
+// Set up a device newly added to Config.Devices - connected state, ports and DB document
+func (device *Device) register() error {
+	connectedDevices, err := getConnectedDevices()
+	if err != nil {
+		return err
+	}
+
+	device.Connected = false
+	for _, connectedDevice := range connectedDevices {
+		if strings.Contains(connectedDevice, device.UDID) {
+			device.Connected = true
+		}
+	}
+	device.trackDisconnect(time.Now())
+	device.Container = nil
+	device.Host = Config.EnvConfig.DevicesHost
+
+	err = device.allocatePorts()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "register_device",
+		}).Error("Could not allocate ports for device " + device.UDID + ", it will not be registered: " + err.Error())
+		return err
+	}
+
+	device.insertDB()
+	device.recordEvent(EventRegistered, "")
+	log.WithFields(log.Fields{
+		"event": "register_device",
+	}).Info("Registered device with udid: " + device.UDID)
+
+	return nil
+}
+
+// Apply new config.json fields to a registered device and remove its container so it is recreated
+func (device *Device) reconfigure(newDevice *Device) {
+	device.applyConfigFields(newDevice)
+	err := device.allocatePorts()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "update_device",
+		}).Error("Could not allocate ports for device " + device.UDID + ": " + err.Error())
+	}
+
+	device.removeExistingContainer()
+	device.updateDB()
+	log.WithFields(log.Fields{
+		"event": "update_device",
+	}).Info("Updated device with udid: " + device.UDID)
+}
+
+// Remove the container and DB document of a device that is no longer registered
+func (device *Device) unregister() {
+	device.removeExistingContainer()
+	lifecycles.forget(device.UDID)
+	err := device.releasePorts()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "port_allocation",
+		}).Error("Could not release the ports of device " + device.UDID + ": " + err.Error())
+	}
+	device.deleteDB()
+	device.recordEvent(EventUnregistered, "")
+	log.WithFields(log.Fields{
+		"event": "unregister_device",
+	}).Info("Unregistered device with udid: " + device.UDID)
+}
+
+// Create, restart or remove the containers only for the provided devices
+func updateDevicesContainers(devices []*Device) {
+	allContainers, err := getHostContainers()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "device_update",
+		}).Error("Could not get host containers: " + err.Error())
+		return
+	}
+
+	for _, device := range devices {
+		device.updateContainer(allContainers)
+	}
+}
+
+// Compare the running devices with the devices from a newly read config.json by UDID
+func diffConfigDevices(currentDevices []*Device, newDevices []*Device) configDiff {
+	diff := configDiff{changed: make(map[*Device]*Device)}
+
+	newDevicesMap := make(map[string]*Device)
+	for _, newDevice := range newDevices {
+		newDevicesMap[newDevice.UDID] = newDevice
+	}
+
+	currentDevicesMap := make(map[string]*Device)
+	for _, device := range currentDevices {
+		currentDevicesMap[device.UDID] = device
+
+		newDevice, ok := newDevicesMap[device.UDID]
+		if !ok {
+			diff.removed = append(diff.removed, device)
+			continue
+		}
+
+		if !device.configEqual(newDevice) {
+			diff.changed[device] = newDevice
+		}
+	}
+
+	for _, newDevice := range newDevices {
+		if _, ok := currentDevicesMap[newDevice.UDID]; !ok {
+			diff.added = append(diff.added, newDevice)
+		}
+	}
+
+	return diff
+}
+
+// Check if the fields provided through config.json are the same for two devices
+func (device *Device) configEqual(other *Device) bool {
+	return device.OS == other.OS &&
+		device.Name == other.Name &&
+		device.OSVersion == other.OSVersion &&
+		device.ScreenSize == other.ScreenSize &&
+		device.Model == other.Model &&
+		device.Image == other.Image &&
+		device.RunMode == other.RunMode &&
+		reflect.DeepEqual(device.ContainerConfig, other.ContainerConfig) &&
+		device.pinnedPorts == other.pinnedPorts
+}
+
+// Copy the fields provided through config.json from another device
+func (device *Device) applyConfigFields(other *Device) {
+	device.OS = other.OS
+	device.Name = other.Name
+	device.OSVersion = other.OSVersion
+	device.ScreenSize = other.ScreenSize
+	device.Model = other.Model
+	device.Image = other.Image
+	device.RunMode = other.RunMode
+	device.ContainerConfig = other.ContainerConfig
+	device.pinnedPorts = other.pinnedPorts
+}
+
+// Get a copy of the devices slice without the provided device
+func removeDevice(devices []*Device, device *Device) []*Device {
+	var filteredDevices []*Device
+	for _, registeredDevice := range devices {
+		if registeredDevice != device {
+			filteredDevices = append(filteredDevices, registeredDevice)
+		}
+	}
+	return filteredDevices
+}
+
+// Watch config.json for changes and reload the devices configuration when it is modified
+func configWatcher() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "config_watcher",
+		}).Error("Could not create config.json watcher: " + err.Error())
+		return
+	}
+	defer watcher.Close()
+
+	// Watch the folder instead of the file because editors often replace the file on save
+	err = watcher.Add("./configs")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "config_watcher",
+		}).Error("Could not add ./configs folder to watcher: " + err.Error())
+		return
+	}
+
+	fmt.Println("Started listening for changes in config.json")
+
+	// Debounce the events because a single save usually produces several of them
+	var reloadTimer *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if filepath.Base(event.Name) != "config.json" {
+				continue
+			}
+
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+				if reloadTimer != nil {
+					reloadTimer.Stop()
+				}
+				reloadTimer = time.AfterFunc(1*time.Second, func() {
+					err := ReloadConfig()
+					if err != nil {
+						log.WithFields(log.Fields{
+							"event": "config_reload",
+						}).Error("Could not reload config.json: " + err.Error())
+					}
+				})
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithFields(log.Fields{
+				"event": "config_watcher",
+			}).Info("There was an error with the config.json watcher: " + err.Error())
+		}
+	}
+}
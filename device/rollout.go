@@ -0,0 +1,408 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrInvalidRollout    = errors.New("invalid image rollout")
+	ErrRolloutInProgress = errors.New("an image rollout is already running for this OS")
+	ErrRolloutNotFound   = errors.New("no image rollout for this OS")
+	ErrRolloutRolledBack = errors.New("image rollout is already rolled back")
+)
+
+// Image rollout states
+const (
+	RolloutRunning    = "running"
+	RolloutCompleted  = "completed"
+	RolloutRolledBack = "rolled_back"
+)
+
+// Rollout states of a single device
+const (
+	RolloutDevicePending        = "pending"
+	RolloutDeviceWaitingSession = "waiting_session"
+	RolloutDeviceUpdating       = "updating"
+	RolloutDeviceUpdated        = "updated"
+	RolloutDeviceSkipped        = "skipped"
+	RolloutDeviceFailed         = "failed"
+	RolloutDeviceRolledBack     = "rolled_back"
+)
+
+const (
+	defaultRolloutHealthTimeoutSec = 300
+	rolloutInterval                = 5 * time.Second
+)
+
+type RolloutRequest struct {
+	Image string `json:"image"`
+	// Maximum number of devices that are recreated at the same time, default 1
+	MaxUnavailable int `json:"max_unavailable,omitempty"`
+	// Time for a new container to become healthy before the rollout is rolled back
+	HealthTimeoutSec int `json:"health_timeout_sec,omitempty"`
+}
+
+// Rolling update of the container image of all devices of an OS
+type Rollout struct {
+	OS               string `json:"os"`
+	Image            string `json:"image"`
+	PreviousImage    string `json:"previous_image"`
+	MaxUnavailable   int    `json:"max_unavailable"`
+	HealthTimeoutSec int    `json:"health_timeout_sec"`
+	State            string `json:"state"`
+	// Why the rollout was rolled back
+	Reason string `json:"reason,omitempty"`
+	// Unix timestamps in milliseconds
+	StartedAt  int64            `json:"started_at"`
+	FinishedAt int64            `json:"finished_at,omitempty"`
+	Updated    int              `json:"updated"`
+	Total      int              `json:"total"`
+	Devices    []*RolloutDevice `json:"devices"`
+	// Image from container-config before the rollout, restored on rollback
+	previousConfigImage string
+}
+
+type RolloutDevice struct {
+	UDID    string `json:"udid"`
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	// Container replaced by the rollout
+	oldContainerID string
+	startedAt      time.Time
+	// When the new container was first seen, the device has to be healthy after that
+	newContainerSeenAt time.Time
+}
+
+// The last rollout of each OS, guarded by configMu
+var rollouts = make(map[string]*Rollout)
+
+// Get the image currently used for the devices of an OS without device overrides
+func osImage(deviceOS string) string {
+	if image := Config.ContainerConfig.forOS(deviceOS).Image; image != "" {
+		return image
+	}
+	if deviceOS == "ios" {
+		return defaultIOSImage
+	}
+	return defaultAndroidImage
+}
+
+func setOSImage(deviceOS string, image string) {
+	switch deviceOS {
+	case "android":
+		Config.ContainerConfig.Android.Image = image
+	case "ios":
+		Config.ContainerConfig.IOS.Image = image
+	}
+}
+
+// Set the target image of an OS and start recreating the device containers with it one by one
+// Devices keep the previous image until the rollout gets to them
+func StartRollout(deviceOS string, request RolloutRequest) (Rollout, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if deviceOS != "ios" && deviceOS != "android" {
+		return Rollout{}, fmt.Errorf("%w: os should be `ios` or `android`, got `%s`", ErrInvalidRollout, deviceOS)
+	}
+	if request.Image == "" || strings.ContainsAny(request.Image, " \t") {
+		return Rollout{}, fmt.Errorf("%w: image should be a non-empty image name without spaces", ErrInvalidRollout)
+	}
+	if request.MaxUnavailable < 0 || request.HealthTimeoutSec < 0 {
+		return Rollout{}, fmt.Errorf("%w: max_unavailable and health_timeout_sec should not be negative", ErrInvalidRollout)
+	}
+	if current, ok := rollouts[deviceOS]; ok && current.State == RolloutRunning {
+		return Rollout{}, ErrRolloutInProgress
+	}
+	if osImage(deviceOS) == request.Image {
+		return Rollout{}, fmt.Errorf("%w: %s devices already use image `%s`", ErrInvalidRollout, deviceOS, request.Image)
+	}
+
+	rollout := &Rollout{
+		OS:                  deviceOS,
+		Image:               request.Image,
+		PreviousImage:       osImage(deviceOS),
+		MaxUnavailable:      request.MaxUnavailable,
+		HealthTimeoutSec:    request.HealthTimeoutSec,
+		State:               RolloutRunning,
+		StartedAt:           time.Now().UnixMilli(),
+		previousConfigImage: Config.ContainerConfig.forOS(deviceOS).Image,
+	}
+	if rollout.MaxUnavailable == 0 {
+		rollout.MaxUnavailable = 1
+	}
+	if rollout.HealthTimeoutSec == 0 {
+		rollout.HealthTimeoutSec = defaultRolloutHealthTimeoutSec
+	}
+
+	for _, device := range Config.Devices {
+		if device.OS != deviceOS {
+			continue
+		}
+
+		rolloutDevice := &RolloutDevice{UDID: device.UDID, State: RolloutDevicePending}
+		switch {
+		case device.runMode() == "native":
+			rolloutDevice.State = RolloutDeviceSkipped
+			rolloutDevice.Message = "device runs in native mode"
+		case device.ContainerConfig != nil && device.ContainerConfig.Image != "":
+			rolloutDevice.State = RolloutDeviceSkipped
+			rolloutDevice.Message = "image is set in the device container_config"
+		default:
+			device.rolloutImage = rollout.PreviousImage
+		}
+		rollout.Devices = append(rollout.Devices, rolloutDevice)
+	}
+
+	setOSImage(deviceOS, request.Image)
+	err := saveConfigJsonData()
+	if err != nil {
+		setOSImage(deviceOS, rollout.previousConfigImage)
+		for _, device := range Config.Devices {
+			if device.OS == deviceOS {
+				device.rolloutImage = ""
+			}
+		}
+		return Rollout{}, err
+	}
+
+	rollouts[deviceOS] = rollout
+	log.WithFields(log.Fields{
+		"event": "image_rollout",
+	}).Info("Started rollout of image " + request.Image + " for " + deviceOS + " devices, previous image: " + rollout.PreviousImage)
+
+	go rollout.run()
+	return rollout.snapshot(), nil
+}
+
+// Get the last rollout of an OS
+func GetRollout(deviceOS string) (Rollout, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	rollout, ok := rollouts[deviceOS]
+	if !ok {
+		return Rollout{}, ErrRolloutNotFound
+	}
+	return rollout.snapshot(), nil
+}
+
+// Get the last rollout of each OS
+func GetRollouts() []Rollout {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	allRollouts := []Rollout{}
+	for _, deviceOS := range []string{"android", "ios"} {
+		if rollout, ok := rollouts[deviceOS]; ok {
+			allRollouts = append(allRollouts, rollout.snapshot())
+		}
+	}
+	return allRollouts
+}
+
+// Roll back a running or completed rollout to the previous image
+func RollbackRollout(deviceOS string) (Rollout, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	rollout, ok := rollouts[deviceOS]
+	if !ok {
+		return Rollout{}, ErrRolloutNotFound
+	}
+	if rollout.State == RolloutRolledBack {
+		return Rollout{}, ErrRolloutRolledBack
+	}
+
+	rollout.rollback("rolled back on request")
+	return rollout.snapshot(), nil
+}
+
+// Copy of the rollout with the progress counters, should be called with configMu held
+func (rollout *Rollout) snapshot() Rollout {
+	rolloutCopy := *rollout
+	rolloutCopy.Devices = []*RolloutDevice{}
+	rolloutCopy.Updated = 0
+	rolloutCopy.Total = 0
+	for _, rolloutDevice := range rollout.Devices {
+		deviceCopy := *rolloutDevice
+		rolloutCopy.Devices = append(rolloutCopy.Devices, &deviceCopy)
+		if rolloutDevice.State == RolloutDeviceSkipped {
+			continue
+		}
+		rolloutCopy.Total++
+		if rolloutDevice.State == RolloutDeviceUpdated {
+			rolloutCopy.Updated++
+		}
+	}
+	return rolloutCopy
+}
+
+func (rollout *Rollout) run() {
+	for {
+		time.Sleep(rolloutInterval)
+
+		configMu.Lock()
+		done := rollout.step()
+		configMu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// Check the updating devices and start updating the next ones, returns true when the rollout is finished
+// Should be called with configMu held
+func (rollout *Rollout) step() bool {
+	if rollout.State != RolloutRunning {
+		return true
+	}
+
+	allContainers, err := getHostContainers()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "image_rollout",
+		}).Error("Could not get host containers: " + err.Error())
+		return false
+	}
+
+	now := time.Now()
+	healthTimeout := time.Duration(rollout.HealthTimeoutSec) * time.Second
+	unavailable := 0
+	for _, rolloutDevice := range rollout.Devices {
+		if rolloutDevice.State != RolloutDeviceUpdating {
+			continue
+		}
+
+		device := getDeviceByUDID(rolloutDevice.UDID)
+		if device == nil {
+			rolloutDevice.State = RolloutDeviceSkipped
+			rolloutDevice.Message = "device was unregistered"
+			continue
+		}
+
+		container := device.findContainer(allContainers)
+		if lifecycles.get(device.UDID).isQuarantined() {
+			rolloutDevice.State = RolloutDeviceFailed
+			rolloutDevice.Message = "device was quarantined"
+		} else if container != nil && container.ID != rolloutDevice.oldContainerID && container.State == "running" {
+			if rolloutDevice.newContainerSeenAt.IsZero() {
+				rolloutDevice.newContainerSeenAt = now
+			}
+			if device.Healthy && device.LastHealthyTimestamp > rolloutDevice.newContainerSeenAt.UnixMilli() {
+				rolloutDevice.State = RolloutDeviceUpdated
+				rolloutDevice.Message = "new container with ID: " + container.ID + " is healthy"
+				continue
+			}
+		}
+
+		if rolloutDevice.State == RolloutDeviceUpdating && now.Sub(rolloutDevice.startedAt) > healthTimeout {
+			rolloutDevice.State = RolloutDeviceFailed
+			rolloutDevice.Message = "new container was not healthy after " + healthTimeout.String()
+		}
+		if rolloutDevice.State == RolloutDeviceFailed {
+			rollout.rollback("device with udid: " + device.UDID + " failed, " + rolloutDevice.Message)
+			return true
+		}
+		unavailable++
+	}
+
+	for _, rolloutDevice := range rollout.Devices {
+		if unavailable >= rollout.MaxUnavailable {
+			break
+		}
+		if rolloutDevice.State != RolloutDevicePending && rolloutDevice.State != RolloutDeviceWaitingSession {
+			continue
+		}
+
+		device := getDeviceByUDID(rolloutDevice.UDID)
+		if device == nil {
+			rolloutDevice.State = RolloutDeviceSkipped
+			rolloutDevice.Message = "device was unregistered"
+			continue
+		}
+
+		if !device.Connected {
+			device.rolloutImage = ""
+			rolloutDevice.State = RolloutDeviceSkipped
+			rolloutDevice.Message = "device is disconnected, the new image is used when it connects"
+			continue
+		}
+
+		if device.hasTestSession() {
+			rolloutDevice.State = RolloutDeviceWaitingSession
+			rolloutDevice.Message = "waiting for the active test session to finish"
+			continue
+		}
+
+		rolloutDevice.State = RolloutDeviceUpdating
+		rolloutDevice.Message = ""
+		rolloutDevice.startedAt = now
+		if container := device.findContainer(allContainers); container != nil {
+			rolloutDevice.oldContainerID = container.ID
+		}
+		unavailable++
+
+		log.WithFields(log.Fields{
+			"event": "image_rollout",
+		}).Info("Updating device with udid: " + device.UDID + " to image " + rollout.Image)
+		device.rolloutImage = ""
+		updateDevicesContainers([]*Device{device})
+	}
+
+	for _, rolloutDevice := range rollout.Devices {
+		if rolloutDevice.State != RolloutDeviceUpdated && rolloutDevice.State != RolloutDeviceSkipped {
+			return false
+		}
+	}
+
+	rollout.State = RolloutCompleted
+	rollout.FinishedAt = now.UnixMilli()
+	log.WithFields(log.Fields{
+		"event": "image_rollout",
+	}).Info("Completed rollout of image " + rollout.Image + " for " + strconv.Itoa(len(rollout.Devices)) + " " + rollout.OS + " devices")
+	return true
+}
+
+// Restore the previous image and recreate the containers that already use the new image
+// Should be called with configMu held
+func (rollout *Rollout) rollback(reason string) {
+	log.WithFields(log.Fields{
+		"event": "image_rollout",
+	}).Warn("Rolling back rollout of image " + rollout.Image + " for " + rollout.OS + " devices to " + rollout.PreviousImage + ": " + reason)
+
+	rollout.State = RolloutRolledBack
+	rollout.Reason = reason
+	rollout.FinishedAt = time.Now().UnixMilli()
+
+	setOSImage(rollout.OS, rollout.previousConfigImage)
+	err := saveConfigJsonData()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "image_rollout",
+		}).Error("Could not save the previous image to config.json: " + err.Error())
+	}
+
+	for _, rolloutDevice := range rollout.Devices {
+		if rolloutDevice.State == RolloutDeviceUpdating || rolloutDevice.State == RolloutDeviceUpdated {
+			rolloutDevice.State = RolloutDeviceRolledBack
+			rolloutDevice.Message = "recreated with image " + rollout.PreviousImage
+		}
+	}
+
+	var devices []*Device
+	for _, device := range Config.Devices {
+		if device.OS == rollout.OS {
+			device.rolloutImage = ""
+			devices = append(devices, device)
+		}
+	}
+	// Only the containers with the new image have a different config hash and get recreated
+	updateDevicesContainers(devices)
+}
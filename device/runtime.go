@@ -0,0 +1,240 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Container runtime used to run the device containers
+type ContainerRuntime interface {
+	// Name of the runtime, e.g. `docker`
+	Name() string
+	// List all containers on the host, including the stopped ones
+	List(ctx context.Context) ([]ContainerInfo, error)
+	// Create a container from the spec and return its ID
+	Create(ctx context.Context, spec ContainerSpec) (string, error)
+	Start(ctx context.Context, containerID string) error
+	Stop(ctx context.Context, containerID string) error
+	Restart(ctx context.Context, containerID string) error
+	Remove(ctx context.Context, containerID string) error
+	// Get the container logs multiplexed in the Docker stream format, the caller should close the reader
+	Logs(ctx context.Context, containerID string, options LogOptions) (io.ReadCloser, error)
+	Inspect(ctx context.Context, containerID string) (ContainerInfo, error)
+	// Get the current resource usage counters of a running container
+	Stats(ctx context.Context, containerID string) (ContainerStats, error)
+	// Run a command in the running container writing its output to stdout and stderr, returns the exit code
+	Exec(ctx context.Context, containerID string, cmd []string, stdout io.Writer, stderr io.Writer) (int, error)
+	// Subscribe to container events until the context is cancelled
+	Events(ctx context.Context) (<-chan RuntimeEvent, <-chan error)
+}
+
+// Runtime independent description of a device container
+type ContainerSpec struct {
+	Name  string
+	Image string
+	// Device OS, used by the native runtime to select the processes to run
+	OS         string
+	Env        []string
+	Labels     map[string]string
+	Ports      []PortBinding
+	Mounts     []MountSpec
+	Devices    []DeviceMapping
+	Privileged bool
+	// Resource limits, 0 means unlimited
+	CPUs     float64
+	MemoryMB int64
+	// Empty uses the default network of the runtime
+	NetworkMode string
+}
+
+type PortBinding struct {
+	ContainerPort string
+	HostPort      string
+}
+
+type MountSpec struct {
+	Source string
+	Target string
+	// Propagate mounts from the host to the container, needed for device symlinks
+	Shared   bool
+	ReadOnly bool
+}
+
+type DeviceMapping struct {
+	HostPath      string
+	ContainerPath string
+}
+
+// Runtime independent state of a container
+type ContainerInfo struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Image  string            `json:"image"`
+	State  string            `json:"state"`
+	Status string            `json:"status,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Unix timestamp in seconds
+	Created int64 `json:"created"`
+}
+
+type LogOptions struct {
+	Stdout bool
+	Stderr bool
+	// Number of lines from the end of the logs, empty or `all` for everything
+	Tail string
+	// Unix timestamp or relative duration like `10m`
+	Since  string
+	Follow bool
+}
+
+// Resource usage counters of a container, the CPU and network counters are cumulative
+type ContainerStats struct {
+	// CPU time used by the container and by the whole host, the CPU usage is calculated from their changes
+	CPUTotalNs  uint64
+	SystemCPUNs uint64
+	OnlineCPUs  int
+	MemoryUsage uint64
+	MemoryLimit uint64
+	NetworkRx   uint64
+	NetworkTx   uint64
+}
+
+// A container lifecycle event reported by the runtime, e.g. `die` or `start`
+type RuntimeEvent struct {
+	ContainerID string            `json:"container_id"`
+	Name        string            `json:"name"`
+	Action      string            `json:"action"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+var containerRuntime ContainerRuntime
+
+// Create the container runtime selected in env-config
+func newContainerRuntime() (ContainerRuntime, error) {
+	switch Config.EnvConfig.ContainerRuntime {
+	case "", "docker":
+		return newDockerRuntime(Config.EnvConfig.ContainerRuntimeSocket)
+	case "podman":
+		return newPodmanRuntime(Config.EnvConfig.ContainerRuntimeSocket)
+	case "fake":
+		return newFakeRuntime(), nil
+	default:
+		return nil, errors.New("Unsupported container runtime: " + Config.EnvConfig.ContainerRuntime)
+	}
+}
+
+// Get the runtime that runs the device services based on its run mode
+func (device *Device) runtime() ContainerRuntime {
+	if device.runMode() == "native" {
+		return nativeRuntimeInstance
+	}
+	return containerRuntime
+}
+
+// Get the run mode of the device, falls back to the env-config run mode
+func (device *Device) runMode() string {
+	if device.RunMode != "" {
+		return device.RunMode
+	}
+	if Config.EnvConfig.RunMode != "" {
+		return Config.EnvConfig.RunMode
+	}
+	return "container"
+}
+
+// Get the runtimes used by the registered devices
+func activeRuntimes() []ContainerRuntime {
+	var useContainers, useNative bool
+	for _, device := range Config.Devices {
+		if device.runMode() == "native" {
+			useNative = true
+		} else {
+			useContainers = true
+		}
+	}
+
+	var runtimes []ContainerRuntime
+	if useContainers {
+		runtimes = append(runtimes, containerRuntime)
+	}
+	if useNative {
+		runtimes = append(runtimes, nativeRuntimeInstance)
+	}
+	return runtimes
+}
+
+// Get the runtime that owns the container with the provided ID
+func runtimeForContainer(containerID string) ContainerRuntime {
+	if strings.HasPrefix(containerID, "native_") {
+		return nativeRuntimeInstance
+	}
+	return containerRuntime
+}
+
+// Get the logs of a container from the runtime that owns it, use ReadLogLines to read them
+// Following logs stops when the context is cancelled
+func GetContainerLogs(ctx context.Context, containerID string, options LogOptions) (io.ReadCloser, error) {
+	runtime := runtimeForContainer(containerID)
+	if runtime == nil {
+		return nil, errors.New("container runtime is not initialized")
+	}
+	return runtime.Logs(ctx, containerID, options)
+}
+
+// Fan out of runtime events to subscribers, used by the runtimes that do not have their own event stream
+type runtimeEvents struct {
+	mu          sync.Mutex
+	subscribers []chan RuntimeEvent
+}
+
+// Subscribe to the events until the context is cancelled
+func (broadcaster *runtimeEvents) subscribe(ctx context.Context) (<-chan RuntimeEvent, <-chan error) {
+	events := make(chan RuntimeEvent, 100)
+	errs := make(chan error, 1)
+
+	broadcaster.mu.Lock()
+	broadcaster.subscribers = append(broadcaster.subscribers, events)
+	broadcaster.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		broadcaster.mu.Lock()
+		defer broadcaster.mu.Unlock()
+		for i, subscriber := range broadcaster.subscribers {
+			if subscriber == events {
+				broadcaster.subscribers = append(broadcaster.subscribers[:i], broadcaster.subscribers[i+1:]...)
+				break
+			}
+		}
+		close(events)
+		errs <- ctx.Err()
+	}()
+
+	return events, errs
+}
+
+// Send an event to the subscribers, slow subscribers miss events instead of blocking the runtime
+func (broadcaster *runtimeEvents) publish(container ContainerInfo, action string) {
+	event := RuntimeEvent{
+		ContainerID: container.ID,
+		Name:        container.Name,
+		Action:      action,
+		Labels:      container.Labels,
+		Timestamp:   time.Now().UnixMilli(),
+	}
+
+	broadcaster.mu.Lock()
+	defer broadcaster.mu.Unlock()
+	for _, subscriber := range broadcaster.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+// Container runtime talking to the Docker Engine API
+type dockerRuntime struct {
+	name string
+	cli  *client.Client
+}
+
+// Create a Docker runtime, uses the DOCKER_HOST environment if socket is empty
+func newDockerRuntime(socket string) (*dockerRuntime, error) {
+	options := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if socket != "" {
+		options = append(options, client.WithHost(socket))
+	}
+
+	cli, err := client.NewClientWithOpts(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{name: "docker", cli: cli}, nil
+}
+
+// Create a Podman runtime using the Docker compatible API of the Podman socket
+// If socket is empty the rootless socket of the current user is used, or the system socket when running as root
+func newPodmanRuntime(socket string) (*dockerRuntime, error) {
+	if socket == "" {
+		socket = defaultPodmanSocket()
+	}
+
+	cli, err := client.NewClientWithOpts(client.WithHost(socket), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{name: "podman", cli: cli}, nil
+}
+
+func defaultPodmanSocket() string {
+	uid := os.Getuid()
+	if uid == 0 {
+		return "unix:///run/podman/podman.sock"
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = "/run/user/" + strconv.Itoa(uid)
+	}
+	return "unix://" + runtimeDir + "/podman/podman.sock"
+}
+
+func (runtime *dockerRuntime) Name() string {
+	return runtime.name
+}
+
+func (runtime *dockerRuntime) List(ctx context.Context) ([]ContainerInfo, error) {
+	containers, err := runtime.cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []ContainerInfo
+	for _, container := range containers {
+		info := ContainerInfo{
+			ID:      container.ID,
+			Image:   container.Image,
+			State:   container.State,
+			Status:  container.Status,
+			Labels:  container.Labels,
+			Created: container.Created,
+		}
+		if len(container.Names) > 0 {
+			info.Name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (runtime *dockerRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	exposedPorts := nat.PortSet{}
+	portBindings := nat.PortMap{}
+	for _, port := range spec.Ports {
+		containerPort := nat.Port(port.ContainerPort)
+		exposedPorts[containerPort] = struct{}{}
+		portBindings[containerPort] = []nat.PortBinding{
+			{
+				HostIP:   "0.0.0.0",
+				HostPort: port.HostPort,
+			},
+		}
+	}
+
+	var mounts []mount.Mount
+	for _, mountSpec := range spec.Mounts {
+		deviceMount := mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   mountSpec.Source,
+			Target:   mountSpec.Target,
+			ReadOnly: mountSpec.ReadOnly,
+		}
+		if mountSpec.Shared {
+			deviceMount.BindOptions = &mount.BindOptions{Propagation: "shared"}
+		}
+		mounts = append(mounts, deviceMount)
+	}
+
+	var devices []container.DeviceMapping
+	for _, device := range spec.Devices {
+		devices = append(devices, container.DeviceMapping{
+			PathOnHost:        device.HostPath,
+			PathInContainer:   device.ContainerPath,
+			CgroupPermissions: "rwm",
+		})
+	}
+
+	containerConfig := &container.Config{
+		Image:        spec.Image,
+		ExposedPorts: exposedPorts,
+		Env:          spec.Env,
+		Labels:       spec.Labels,
+	}
+
+	hostConfig := &container.HostConfig{
+		Privileged:   spec.Privileged,
+		PortBindings: portBindings,
+		Mounts:       mounts,
+		NetworkMode:  container.NetworkMode(spec.NetworkMode),
+		Resources: container.Resources{
+			Devices:  devices,
+			NanoCPUs: int64(spec.CPUs * 1e9),
+			Memory:   spec.MemoryMB * 1024 * 1024,
+		},
+	}
+
+	resp, err := runtime.cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, spec.Name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (runtime *dockerRuntime) Start(ctx context.Context, containerID string) error {
+	return runtime.cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+}
+
+func (runtime *dockerRuntime) Stop(ctx context.Context, containerID string) error {
+	return runtime.cli.ContainerStop(ctx, containerID, nil)
+}
+
+func (runtime *dockerRuntime) Restart(ctx context.Context, containerID string) error {
+	return runtime.cli.ContainerRestart(ctx, containerID, nil)
+}
+
+func (runtime *dockerRuntime) Remove(ctx context.Context, containerID string) error {
+	return runtime.cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{})
+}
+
+func (runtime *dockerRuntime) Logs(ctx context.Context, containerID string, options LogOptions) (io.ReadCloser, error) {
+	out, err := runtime.cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: options.Stdout,
+		ShowStderr: options.Stderr,
+		Tail:       options.Tail,
+		Since:      options.Since,
+		Follow:     options.Follow,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The device containers run without a TTY so stdout and stderr are already multiplexed with frame headers
+	return out, nil
+}
+
+func (runtime *dockerRuntime) Inspect(ctx context.Context, containerID string) (ContainerInfo, error) {
+	inspect, err := runtime.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+
+	info := ContainerInfo{
+		ID:   inspect.ID,
+		Name: strings.TrimPrefix(inspect.Name, "/"),
+	}
+	if inspect.Config != nil {
+		info.Image = inspect.Config.Image
+		info.Labels = inspect.Config.Labels
+	}
+	if inspect.State != nil {
+		info.State = inspect.State.Status
+	}
+	created, err := time.Parse(time.RFC3339Nano, inspect.Created)
+	if err == nil {
+		info.Created = created.Unix()
+	}
+	return info, nil
+}
+
+func (runtime *dockerRuntime) Stats(ctx context.Context, containerID string) (ContainerStats, error) {
+	resp, err := runtime.cli.ContainerStatsOneShot(ctx, containerID)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	defer resp.Body.Close()
+
+	var statsJSON types.StatsJSON
+	err = json.NewDecoder(resp.Body).Decode(&statsJSON)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+
+	stats := ContainerStats{
+		CPUTotalNs:  statsJSON.CPUStats.CPUUsage.TotalUsage,
+		SystemCPUNs: statsJSON.CPUStats.SystemUsage,
+		OnlineCPUs:  int(statsJSON.CPUStats.OnlineCPUs),
+		MemoryUsage: statsJSON.MemoryStats.Usage,
+		MemoryLimit: statsJSON.MemoryStats.Limit,
+	}
+	if stats.OnlineCPUs == 0 {
+		stats.OnlineCPUs = len(statsJSON.CPUStats.CPUUsage.PercpuUsage)
+	}
+	// Same as `docker stats`, the page cache that can be reclaimed is not counted as used memory
+	if inactive, ok := statsJSON.MemoryStats.Stats["inactive_file"]; ok && inactive < stats.MemoryUsage {
+		stats.MemoryUsage -= inactive
+	} else if inactive, ok := statsJSON.MemoryStats.Stats["total_inactive_file"]; ok && inactive < stats.MemoryUsage {
+		stats.MemoryUsage -= inactive
+	}
+	for _, network := range statsJSON.Networks {
+		stats.NetworkRx += network.RxBytes
+		stats.NetworkTx += network.TxBytes
+	}
+
+	return stats, nil
+}
+
+func (runtime *dockerRuntime) Exec(ctx context.Context, containerID string, cmd []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	execResp, err := runtime.cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	attach, err := runtime.cli.ContainerExecAttach(ctx, execResp.ID, types.ExecStartCheck{})
+	if err != nil {
+		return 0, err
+	}
+	defer attach.Close()
+
+	// The hijacked connection does not follow the context so it is closed when the context is done
+	// The command itself keeps running in the container because exec processes cannot be killed through the API,
+	// so ErrExecNotStopped is returned instead of the plain context error
+	copied := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, attach.Reader)
+		copied <- err
+	}()
+	select {
+	case err = <-copied:
+		if err != nil {
+			return 0, err
+		}
+	case <-ctx.Done():
+		attach.Close()
+		<-copied
+		return 0, fmt.Errorf("%w: %s", ErrExecNotStopped, ctx.Err())
+	}
+
+	// The output can end slightly before the exec is reported as finished
+	for {
+		inspect, err := runtime.cli.ContainerExecInspect(ctx, execResp.ID)
+		if err != nil {
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("%w: %s", ErrExecNotStopped, ctx.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (runtime *dockerRuntime) Events(ctx context.Context) (<-chan RuntimeEvent, <-chan error) {
+	messages, errs := runtime.cli.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(filters.Arg("type", "container")),
+	})
+
+	events := make(chan RuntimeEvent)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				event := RuntimeEvent{
+					ContainerID: message.Actor.ID,
+					Name:        message.Actor.Attributes["name"],
+					Action:      message.Action,
+					Labels:      message.Actor.Attributes,
+					Timestamp:   message.TimeNano / int64(time.Millisecond),
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, errs
+}
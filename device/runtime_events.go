@@ -0,0 +1,193 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	minEventsBackoff = time.Second
+	maxEventsBackoff = 30 * time.Second
+	// How often to check if a runtime that is not used by any device started being used
+	eventsIdleInterval = 30 * time.Second
+)
+
+// Watch the events of the container runtimes to notice device containers dying without a /dev change
+func watchRuntimeEvents() {
+	go watchEvents(containerRuntime, func(device *Device) bool {
+		return device.runMode() != "native"
+	})
+	go watchEvents(nativeRuntimeInstance, func(device *Device) bool {
+		return device.runMode() == "native"
+	})
+}
+
+// Consume the events of a runtime while it is used by any device, resubscribing with backoff on errors
+func watchEvents(runtime ContainerRuntime, usedBy func(device *Device) bool) {
+	backoff := minEventsBackoff
+	for {
+		if !runtimeInUse(usedBy) {
+			time.Sleep(eventsIdleInterval)
+			continue
+		}
+
+		received, err := consumeEvents(runtime)
+		if received {
+			backoff = minEventsBackoff
+		}
+		log.WithFields(log.Fields{
+			"event": "runtime_events",
+		}).Warn("Lost " + runtime.Name() + " event stream, resubscribing in " + backoff.String() + ": " + err.Error())
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxEventsBackoff {
+			backoff = maxEventsBackoff
+		}
+	}
+}
+
+func runtimeInUse(usedBy func(device *Device) bool) bool {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	for _, device := range Config.Devices {
+		if usedBy(device) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle the events until the stream fails, returns if any event was received
+func consumeEvents(runtime ContainerRuntime) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := false
+	events, errs := runtime.Events(ctx)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return received, errors.New("event stream closed")
+			}
+			received = true
+			handleRuntimeEvent(event)
+		case err := <-errs:
+			if err == nil {
+				err = errors.New("event stream closed")
+			}
+			return received, err
+		}
+	}
+}
+
+// Get the container status after the event and whether the event means the container needs recovery
+// Returns an empty status for events that do not change the container state, e.g. exec
+func eventContainerStatus(event RuntimeEvent) (string, bool) {
+	switch {
+	case event.Action == "start", event.Action == "restart":
+		return "Up", false
+	case event.Action == "die":
+		exitCode := event.Labels["exitCode"]
+		if exitCode == "" {
+			return "Exited", true
+		}
+		return "Exited (" + exitCode + ")", true
+	case event.Action == "oom":
+		return "OOM killed", true
+	case event.Action == "stop":
+		return "Exited", false
+	case event.Action == "destroy":
+		return "Removed", false
+	case strings.HasPrefix(event.Action, "health_status"):
+		if strings.HasSuffix(event.Action, "unhealthy") {
+			return "Up (unhealthy)", true
+		}
+		return "Up (healthy)", false
+	}
+	return "", false
+}
+
+// Update the device container status and apply the recovery policy if the container died
+func handleRuntimeEvent(event RuntimeEvent) {
+	udid := deviceUDIDFromLabels(event.Labels)
+	if udid == "" {
+		return
+	}
+
+	status, recover := eventContainerStatus(event)
+	if status == "" {
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	device := getDeviceByUDID(udid)
+	if device == nil {
+		return
+	}
+	// Ignore late events of a container that was already replaced
+	if device.Container != nil && device.Container.ContainerID != event.ContainerID {
+		return
+	}
+
+	if device.Container == nil {
+		// Events of removed containers are ignored, only a started container is attached to the device
+		if !strings.HasPrefix(status, "Up") {
+			return
+		}
+		// The container was created after the last device update
+		device.Container = &DeviceContainer{
+			ContainerID:     event.ContainerID,
+			ContainerStatus: status,
+			ImageName:       event.Labels["image"],
+			ContainerName:   event.Name,
+		}
+	} else if event.Action == "destroy" {
+		device.Container = nil
+	} else {
+		device.Container.ContainerStatus = status
+	}
+	device.updateDB()
+
+	// Containers stopped by the provider itself, e.g. while restarting, are not recovered
+	// Late events from before the last transition finished were already handled by it
+	lifecycle := lifecycles.get(device.UDID)
+	if !recover || lifecycle.isScheduled() || lifecycle.predates(event.Timestamp) {
+		return
+	}
+
+	device.recordEvent(EventContainerDied, "Container with ID: "+event.ContainerID+" "+strings.ToLower(status))
+	log.WithFields(log.Fields{
+		"event": "runtime_events",
+	}).Warn("Container of device with udid: " + device.UDID + " changed to " + status)
+	device.recoverContainer(event.ContainerID, strings.Contains(status, "unhealthy"))
+}
+
+// Reconcile the device container right away after it died or became unhealthy
+// Should be called with configMu held
+func (device *Device) recoverContainer(containerID string, unhealthy bool) {
+	allContainers, err := getHostContainers()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "runtime_events",
+		}).Error("Could not get host containers: " + err.Error())
+		return
+	}
+
+	container := device.findContainer(allContainers)
+	// An unhealthy container is still running, treat it as failed so it is restarted with backoff
+	if unhealthy && container != nil && container.ID == containerID && container.State == "running" {
+		failedContainer := *container
+		failedContainer.State = "unhealthy"
+		container = &failedContainer
+	}
+	device.reconcileContainer(container)
+}
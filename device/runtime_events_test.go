@@ -0,0 +1,52 @@
+package device
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHandleRuntimeEventIgnoresEventsBeforeTransition(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	fake := setupFakeProvider(t, device)
+
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerCreated, 1)
+	container := listContainers(t, fake)[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, _ := fake.Events(ctx)
+
+	// The container dies and the provider restarts it before the die event is handled
+	err := fake.Stop(context.Background(), container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateDevicesLocked()
+	waitForEvents(t, device.UDID, EventContainerRestarted, 1)
+
+	var died RuntimeEvent
+	select {
+	case died = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the die event")
+	}
+	if died.Action != "die" {
+		t.Fatalf("expected a die event, got %s", died.Action)
+	}
+
+	lifecycle := lifecycles.get(device.UDID)
+	failures := lifecycle.recentFailures(time.Now())
+	handleRuntimeEvent(died)
+
+	waitForEvents(t, device.UDID, EventContainerDied, 0)
+	if recent := lifecycle.recentFailures(time.Now()); recent != failures {
+		t.Errorf("expected the late event not to count as a failure, got %d failures instead of %d", recent, failures)
+	}
+
+	// A die event after the restart is a new failure
+	died.Timestamp = time.Now().Add(time.Second).UnixMilli()
+	handleRuntimeEvent(died)
+	waitForEvents(t, device.UDID, EventContainerDied, 1)
+}
@@ -0,0 +1,176 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory container runtime that does not run anything
+// Useful for testing the container lifecycle logic without Docker
+type fakeRuntime struct {
+	mu         sync.Mutex
+	nextID     int
+	containers map[string]*ContainerInfo
+	events     runtimeEvents
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{
+		containers: make(map[string]*ContainerInfo),
+	}
+}
+
+func (runtime *fakeRuntime) Name() string {
+	return "fake"
+}
+
+func (runtime *fakeRuntime) List(ctx context.Context) ([]ContainerInfo, error) {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	var infos []ContainerInfo
+	for _, container := range runtime.containers {
+		infos = append(infos, *container)
+	}
+	return infos, nil
+}
+
+func (runtime *fakeRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	for _, container := range runtime.containers {
+		if container.Name == spec.Name {
+			return "", errors.New("container name " + spec.Name + " is already in use")
+		}
+	}
+
+	runtime.nextID++
+	containerID := "fake" + strconv.Itoa(runtime.nextID)
+	labels := make(map[string]string)
+	for key, value := range spec.Labels {
+		labels[key] = value
+	}
+	runtime.containers[containerID] = &ContainerInfo{
+		ID:      containerID,
+		Name:    spec.Name,
+		Image:   spec.Image,
+		State:   "created",
+		Status:  "Created",
+		Labels:  labels,
+		Created: time.Now().Unix(),
+	}
+	runtime.events.publish(*runtime.containers[containerID], "create")
+	return containerID, nil
+}
+
+func (runtime *fakeRuntime) Start(ctx context.Context, containerID string) error {
+	return runtime.setState(containerID, "running", "Up", "start")
+}
+
+func (runtime *fakeRuntime) Stop(ctx context.Context, containerID string) error {
+	return runtime.setState(containerID, "exited", "Exited (0)", "die")
+}
+
+func (runtime *fakeRuntime) Restart(ctx context.Context, containerID string) error {
+	return runtime.setState(containerID, "running", "Up", "restart")
+}
+
+func (runtime *fakeRuntime) Remove(ctx context.Context, containerID string) error {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	if _, ok := runtime.containers[containerID]; !ok {
+		return errors.New("no such container: " + containerID)
+	}
+	runtime.events.publish(*runtime.containers[containerID], "destroy")
+	delete(runtime.containers, containerID)
+	return nil
+}
+
+func (runtime *fakeRuntime) Logs(ctx context.Context, containerID string, options LogOptions) (io.ReadCloser, error) {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	if _, ok := runtime.containers[containerID]; !ok {
+		return nil, errors.New("no such container: " + containerID)
+	}
+	// Fake containers do not produce any output
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (runtime *fakeRuntime) Inspect(ctx context.Context, containerID string) (ContainerInfo, error) {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	container, ok := runtime.containers[containerID]
+	if !ok {
+		return ContainerInfo{}, errors.New("no such container: " + containerID)
+	}
+	return *container, nil
+}
+
+// Fake containers do not use any resources
+func (runtime *fakeRuntime) Stats(ctx context.Context, containerID string) (ContainerStats, error) {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	if _, ok := runtime.containers[containerID]; !ok {
+		return ContainerStats{}, errors.New("no such container: " + containerID)
+	}
+	return ContainerStats{OnlineCPUs: 1}, nil
+}
+
+// Fake containers only echo the command
+func (runtime *fakeRuntime) Exec(ctx context.Context, containerID string, cmd []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	runtime.mu.Lock()
+	container, ok := runtime.containers[containerID]
+	if !ok {
+		runtime.mu.Unlock()
+		return 0, errors.New("no such container: " + containerID)
+	}
+	state := container.State
+	runtime.mu.Unlock()
+
+	if state != "running" {
+		return 0, errors.New("container " + containerID + " is not running")
+	}
+	// `sleep {seconds}` runs until it is done or the context is done, like a long running command
+	if len(cmd) == 2 && cmd[0] == "sleep" {
+		seconds, err := strconv.Atoi(cmd[1])
+		if err != nil {
+			return 1, nil
+		}
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	_, err := io.WriteString(stdout, strings.Join(cmd, " ")+"\n")
+	return 0, err
+}
+
+func (runtime *fakeRuntime) Events(ctx context.Context) (<-chan RuntimeEvent, <-chan error) {
+	return runtime.events.subscribe(ctx)
+}
+
+func (runtime *fakeRuntime) setState(containerID string, state string, status string, action string) error {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	container, ok := runtime.containers[containerID]
+	if !ok {
+		return errors.New("no such container: " + containerID)
+	}
+	container.State = state
+	container.Status = status
+	runtime.events.publish(*container, action)
+	return nil
+}
@@ -0,0 +1,591 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	log "github.com/sirupsen/logrus"
+)
+
+// A host process started for each device in native mode
+type NativeProcess struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+	// Environment variables like $APPIUM_PORT are expanded in the arguments
+	Args []string `json:"args,omitempty"`
+}
+
+// Processes started for the devices of each OS in native mode
+type NativeConfig struct {
+	Android []NativeProcess `json:"android,omitempty"`
+	IOS     []NativeProcess `json:"ios,omitempty"`
+}
+
+// Processes used when native-config does not provide any for the device OS
+var defaultNativeProcesses = []NativeProcess{
+	{
+		Name:    "appium",
+		Command: "appium",
+		Args:    []string{"-p", "$APPIUM_PORT", "--log-timestamp"},
+	},
+	{
+		Name:    "container-server",
+		Command: "container-server",
+	},
+}
+
+// The Android stream is served by the container-server, on iOS the WebDriverAgent MJPEG port
+// of the device is forwarded to the stream port like in the iOS container
+var defaultIOSStreamProcess = NativeProcess{
+	Name:    "stream",
+	Command: "ios",
+	Args:    []string{"forward", "--udid=$DEVICE_UDID", "$STREAM_PORT", "9100"},
+}
+
+const nativeStopTimeout = 10 * time.Second
+
+// Runtime that runs the device services as supervised host processes instead of containers
+// Each device "container" is a group of processes that is started, stopped and restarted together
+type nativeRuntime struct {
+	mu     sync.Mutex
+	nextID int
+	groups map[string]*processGroup
+	events runtimeEvents
+}
+
+type processGroup struct {
+	info      ContainerInfo
+	spec      ContainerSpec
+	processes []NativeProcess
+	env       []string
+	logsDir   string
+	running   []*runningProcess
+	// Incremented on each start so exits of processes from a previous start are ignored
+	generation int
+}
+
+type runningProcess struct {
+	name string
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+var nativeRuntimeInstance *nativeRuntime
+
+func newNativeRuntime() *nativeRuntime {
+	return &nativeRuntime{
+		groups: make(map[string]*processGroup),
+	}
+}
+
+func (runtime *nativeRuntime) Name() string {
+	return "native"
+}
+
+func (runtime *nativeRuntime) List(ctx context.Context) ([]ContainerInfo, error) {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	var infos []ContainerInfo
+	for _, group := range runtime.groups {
+		infos = append(infos, group.info)
+	}
+	return infos, nil
+}
+
+func (runtime *nativeRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	processes := nativeProcessesForOS(spec.OS)
+
+	// The logs and apps folders are mounted in the containers, in native mode the processes get their host paths
+	env := append(os.Environ(), spec.Env...)
+	var logsDir string
+	for _, mount := range spec.Mounts {
+		switch mount.Target {
+		case "/opt/logs":
+			logsDir = mount.Source
+			env = append(env, "LOGS_DIR="+mount.Source)
+		case "/opt/apk", "/opt/ipa":
+			env = append(env, "APPS_DIR="+mount.Source)
+		}
+	}
+	if logsDir == "" {
+		return "", errors.New("the spec for " + spec.Name + " does not provide a logs folder")
+	}
+
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	for _, group := range runtime.groups {
+		if group.info.Name == spec.Name {
+			return "", errors.New("process group name " + spec.Name + " is already in use")
+		}
+	}
+
+	runtime.nextID++
+	containerID := "native_" + strconv.Itoa(runtime.nextID)
+	group := &processGroup{
+		info: ContainerInfo{
+			ID:      containerID,
+			Name:    spec.Name,
+			Image:   "native",
+			State:   "created",
+			Status:  "Created",
+			Labels:  spec.Labels,
+			Created: time.Now().Unix(),
+		},
+		spec:      spec,
+		processes: processes,
+		env:       env,
+		logsDir:   logsDir,
+	}
+	runtime.groups[containerID] = group
+	runtime.events.publish(group.info, "create")
+	return containerID, nil
+}
+
+func (runtime *nativeRuntime) Start(ctx context.Context, containerID string) error {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		return errors.New("no such process group: " + containerID)
+	}
+	if group.info.State == "running" {
+		return nil
+	}
+	return runtime.startLocked(group)
+}
+
+func (runtime *nativeRuntime) Stop(ctx context.Context, containerID string) error {
+	runtime.mu.Lock()
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		runtime.mu.Unlock()
+		return errors.New("no such process group: " + containerID)
+	}
+	running := runtime.markStoppedLocked(group, 0)
+	runtime.mu.Unlock()
+
+	stopProcesses(running)
+	return nil
+}
+
+func (runtime *nativeRuntime) Restart(ctx context.Context, containerID string) error {
+	err := runtime.Stop(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		return errors.New("no such process group: " + containerID)
+	}
+	return runtime.startLocked(group)
+}
+
+func (runtime *nativeRuntime) Remove(ctx context.Context, containerID string) error {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		return errors.New("no such process group: " + containerID)
+	}
+	if group.info.State == "running" {
+		return errors.New("cannot remove running process group " + containerID + ", stop it first")
+	}
+	runtime.events.publish(group.info, "destroy")
+	delete(runtime.groups, containerID)
+	return nil
+}
+
+// Get the logs of all processes in the group, each prefixed with a header line with the process name
+func (runtime *nativeRuntime) Logs(ctx context.Context, containerID string, options LogOptions) (io.ReadCloser, error) {
+	if options.Follow {
+		return nil, errors.New("following logs is not supported by the native runtime")
+	}
+
+	runtime.mu.Lock()
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		runtime.mu.Unlock()
+		return nil, errors.New("no such process group: " + containerID)
+	}
+	logsDir := group.logsDir
+	processes := group.processes
+	runtime.mu.Unlock()
+
+	tail, err := strconv.Atoi(options.Tail)
+	if err != nil {
+		tail = -1
+	}
+
+	var buf bytes.Buffer
+	for _, process := range processes {
+		content, err := ioutil.ReadFile(filepath.Join(logsDir, process.Name+".log"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		lines := strings.SplitAfter(string(content), "\n")
+		if len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if tail >= 0 && len(lines) > tail {
+			lines = lines[len(lines)-tail:]
+		}
+
+		buf.WriteString("==> " + process.Name + " <==\n")
+		buf.WriteString(strings.Join(lines, ""))
+	}
+
+	// The process logs contain both stdout and stderr so everything is framed as stdout
+	var framed bytes.Buffer
+	_, err = stdcopy.NewStdWriter(&framed, stdcopy.Stdout).Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&framed), nil
+}
+
+// Linux reports the CPU times in /proc in clock ticks of 1/100 of a second
+const procClockTicksNs = uint64(time.Second / 100)
+
+// Sum the CPU and memory usage of the processes of the group and their children from /proc
+// The processes do not have their own network so the network counters are not reported
+func (runtime *nativeRuntime) Stats(ctx context.Context, containerID string) (ContainerStats, error) {
+	runtime.mu.Lock()
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		runtime.mu.Unlock()
+		return ContainerStats{}, errors.New("no such process group: " + containerID)
+	}
+	// Each process is started in its own process group so its children share the process group ID
+	processGroups := make(map[string]bool)
+	for _, process := range group.running {
+		processGroups[strconv.Itoa(process.cmd.Process.Pid)] = true
+	}
+	runtime.mu.Unlock()
+
+	stats := ContainerStats{
+		OnlineCPUs: goruntime.NumCPU(),
+	}
+
+	procStats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	for _, procStat := range procStats {
+		content, err := ioutil.ReadFile(procStat)
+		if err != nil {
+			// The process exited after listing /proc
+			continue
+		}
+
+		// The process name can contain spaces so the fields are read after its closing parenthesis
+		nameEnd := strings.LastIndexByte(string(content), ')')
+		if nameEnd < 0 {
+			continue
+		}
+		// Fields after the name start from the process state, field 3 in proc(5)
+		fields := strings.Fields(string(content[nameEnd+1:]))
+		if len(fields) < 22 || !processGroups[fields[2]] {
+			continue
+		}
+
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rssPages, _ := strconv.ParseUint(fields[21], 10, 64)
+		stats.CPUTotalNs += (utime + stime) * procClockTicksNs
+		stats.MemoryUsage += rssPages * uint64(os.Getpagesize())
+	}
+
+	stats.SystemCPUNs, err = hostCPUTimeNs()
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	stats.MemoryLimit, err = hostMemoryBytes()
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	return stats, nil
+}
+
+// Get the total CPU time of all host CPUs from the first line of /proc/stat
+func hostCPUTimeNs() (uint64, error) {
+	content, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+
+	line := strings.SplitN(string(content), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "cpu" {
+		return 0, errors.New("unexpected /proc/stat format")
+	}
+
+	// Guest time is already included in user time so only user to steal are summed
+	if len(fields) > 9 {
+		fields = fields[:9]
+	}
+	var total uint64
+	for _, field := range fields[1:] {
+		ticks, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, errors.New("unexpected /proc/stat format: " + err.Error())
+		}
+		total += ticks
+	}
+	return total * procClockTicksNs, nil
+}
+
+// Get the total memory of the host from /proc/meminfo
+func hostMemoryBytes() (uint64, error) {
+	content, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kilobytes, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kilobytes * 1024, nil
+		}
+	}
+	return 0, errors.New("MemTotal not found in /proc/meminfo")
+}
+
+// Run the command on the host with the environment of the device processes
+func (runtime *nativeRuntime) Exec(ctx context.Context, containerID string, cmd []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(cmd) == 0 {
+		return 0, errors.New("no command provided")
+	}
+
+	runtime.mu.Lock()
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		runtime.mu.Unlock()
+		return 0, errors.New("no such process group: " + containerID)
+	}
+	env := group.env
+	state := group.info.State
+	runtime.mu.Unlock()
+
+	if state != "running" {
+		return 0, errors.New("process group " + containerID + " is not running")
+	}
+
+	command := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	command.Env = env
+	command.Stdout = stdout
+	command.Stderr = stderr
+	err := command.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (runtime *nativeRuntime) Inspect(ctx context.Context, containerID string) (ContainerInfo, error) {
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+
+	group, ok := runtime.groups[containerID]
+	if !ok {
+		return ContainerInfo{}, errors.New("no such process group: " + containerID)
+	}
+	return group.info, nil
+}
+
+func (runtime *nativeRuntime) Events(ctx context.Context) (<-chan RuntimeEvent, <-chan error) {
+	return runtime.events.subscribe(ctx)
+}
+
+// Start all processes of the group, if one of them fails to start the already started ones are stopped
+func (runtime *nativeRuntime) startLocked(group *processGroup) error {
+	group.generation++
+	generation := group.generation
+
+	var running []*runningProcess
+	for _, process := range group.processes {
+		runningProcess, err := startNativeProcess(process, group.env, group.logsDir)
+		if err != nil {
+			go stopProcesses(running)
+			group.generation++
+			group.running = nil
+			group.info.State = "exited"
+			group.info.Status = "Exited (127)"
+			return errors.New("could not start process " + process.Name + ": " + err.Error())
+		}
+		running = append(running, runningProcess)
+		go runtime.watchProcess(group, generation, runningProcess)
+	}
+
+	group.running = running
+	group.info.State = "running"
+	group.info.Status = "Up"
+	runtime.events.publish(group.info, "start")
+	return nil
+}
+
+// Mark the group as stopped and return the processes that should be stopped
+func (runtime *nativeRuntime) markStoppedLocked(group *processGroup, exitCode int) []*runningProcess {
+	running := group.running
+	group.running = nil
+	group.generation++
+	if group.info.State == "running" {
+		group.info.State = "exited"
+		group.info.Status = "Exited (" + strconv.Itoa(exitCode) + ")"
+		runtime.events.publish(group.info, "die")
+	}
+	return running
+}
+
+// Wait for a process to exit and stop the whole group
+// The group is not restarted here, the provider restarts it with a backoff like a failed container
+func (runtime *nativeRuntime) watchProcess(group *processGroup, generation int, process *runningProcess) {
+	<-process.done
+	exitCode := process.cmd.ProcessState.ExitCode()
+
+	runtime.mu.Lock()
+	if group.generation != generation {
+		// The group was stopped or restarted meanwhile
+		runtime.mu.Unlock()
+		return
+	}
+	running := runtime.markStoppedLocked(group, exitCode)
+	runtime.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"event": "native_process_exit",
+	}).Warn("Process " + process.name + " of " + group.info.Name + " exited with code " + strconv.Itoa(exitCode))
+
+	stopProcesses(running)
+}
+
+// Start a process in its own process group so it can be stopped together with its children
+func startNativeProcess(process NativeProcess, env []string, logsDir string) (*runningProcess, error) {
+	envMap := make(map[string]string)
+	for _, variable := range env {
+		keyValue := strings.SplitN(variable, "=", 2)
+		if len(keyValue) == 2 {
+			envMap[keyValue[0]] = keyValue[1]
+		}
+	}
+
+	var args []string
+	for _, arg := range process.Args {
+		args = append(args, os.Expand(arg, func(key string) string {
+			return envMap[key]
+		}))
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(logsDir, process.Name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(process.Command, args...)
+	cmd.Env = env
+	cmd.Dir = logsDir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+
+	running := &runningProcess{
+		name: process.Name,
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		logFile.Close()
+		close(running.done)
+	}()
+	return running, nil
+}
+
+// Terminate the processes and kill them if they do not exit in time
+func stopProcesses(processes []*runningProcess) {
+	for _, process := range processes {
+		syscall.Kill(-process.cmd.Process.Pid, syscall.SIGTERM)
+	}
+
+	timeout := time.NewTimer(nativeStopTimeout)
+	defer timeout.Stop()
+	for _, process := range processes {
+		select {
+		case <-process.done:
+			continue
+		case <-timeout.C:
+		}
+
+		// Kill all the processes that did not exit in time
+		for _, remaining := range processes {
+			select {
+			case <-remaining.done:
+			default:
+				syscall.Kill(-remaining.cmd.Process.Pid, syscall.SIGKILL)
+			}
+		}
+		break
+	}
+
+	for _, process := range processes {
+		<-process.done
+	}
+}
+
+// Get the processes configured for the OS in native-config or the default ones
+func nativeProcessesForOS(deviceOS string) []NativeProcess {
+	var processes []NativeProcess
+	switch deviceOS {
+	case "android":
+		processes = Config.NativeConfig.Android
+	case "ios":
+		processes = Config.NativeConfig.IOS
+	}
+	if len(processes) == 0 {
+		if deviceOS == "ios" {
+			return append(append([]NativeProcess{}, defaultNativeProcesses...), defaultIOSStreamProcess)
+		}
+		return defaultNativeProcesses
+	}
+	return processes
+}
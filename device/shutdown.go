@@ -0,0 +1,137 @@
+package device
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultShutdownTimeoutSec = 30
+
+// Closed when the provider starts shutting down
+var shutdownCh = make(chan struct{})
+
+func shuttingDown() bool {
+	select {
+	case <-shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// How long the in-flight requests are drained and the device containers are stopped on shutdown
+func ShutdownTimeout() time.Duration {
+	if Config.EnvConfig.ShutdownTimeoutSec > 0 {
+		return time.Duration(Config.EnvConfig.ShutdownTimeoutSec) * time.Second
+	}
+	return defaultShutdownTimeoutSec * time.Second
+}
+
+// Stop the device updates, mark the devices offline in the store and stop their containers if `stop_containers_on_shutdown` is set
+// Native process groups are always stopped since they cannot be adopted after a restart
+// configMu is kept locked so no device update runs after the shutdown
+func Shutdown(ctx context.Context) {
+	configMu.Lock()
+	close(shutdownCh)
+
+	// Wait for the running transitions and skip the scheduled ones
+	for _, device := range Config.Devices {
+		lifecycle := lifecycles.get(device.UDID)
+		lifecycle.stopRetry()
+		lifecycle.lockSync(lifecycle.State())
+	}
+
+	allContainers, err := getHostContainers()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "provider_shutdown",
+		}).Error("Could not get host containers: " + err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for _, device := range Config.Devices {
+		container := device.findContainer(allContainers)
+		if container != nil {
+			runtime := runtimeForContainer(container.ID)
+			if Config.EnvConfig.StopContainersOnShutdown || runtime.Name() == "native" {
+				wg.Add(1)
+				go func(runtime ContainerRuntime, containerID string) {
+					defer wg.Done()
+					stopContainerOnShutdown(ctx, runtime, containerID)
+				}(runtime, container.ID)
+			}
+		}
+
+		device.Connected = false
+		device.setHealthState(false, "provider is shutting down", time.Now())
+		device.updateDB()
+	}
+	wg.Wait()
+
+	// Write the offline devices right away and ignore the updates of health checks that are still running
+	writer.close()
+
+	err = store.Close()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "provider_shutdown",
+		}).Error("Could not close the device store: " + err.Error())
+	}
+}
+
+func stopContainerOnShutdown(ctx context.Context, runtime ContainerRuntime, containerID string) {
+	log.WithFields(log.Fields{
+		"event": "provider_shutdown",
+	}).Info("Stopping container with ID: " + containerID)
+
+	err := runtime.Stop(ctx, containerID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "provider_shutdown",
+		}).Error("Could not stop container with ID: " + containerID + ": " + err.Error())
+	}
+}
+
+// Adopt the containers of the connected devices left from the previous provider run
+// Up to date containers that were stopped on shutdown are started again instead of being restarted as failed
+// Outdated containers are left to the reconcile which recreates them
+// Should be called with configMu held
+func adoptContainers() {
+	allContainers, err := getHostContainers()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "container_adopt",
+		}).Error("Could not get host containers: " + err.Error())
+		return
+	}
+
+	for _, device := range Config.Devices {
+		container := device.findContainer(allContainers)
+		if container == nil || !device.Connected {
+			continue
+		}
+
+		spec, err := device.containerSpec()
+		if err != nil || container.Labels[labelConfigHash] != spec.Labels[labelConfigHash] {
+			continue
+		}
+
+		if container.State != "running" && container.State != "restarting" {
+			err = runtimeForContainer(container.ID).Start(context.Background(), container.ID)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"event": "container_adopt",
+				}).Error("Could not start container with ID: " + container.ID + " for device with udid: " + device.UDID + ": " + err.Error())
+				continue
+			}
+		}
+
+		device.recordEvent(EventContainerAdopted, "Adopted container with ID: "+container.ID)
+		log.WithFields(log.Fields{
+			"event": "container_adopt",
+		}).Info("Adopted container with ID: " + container.ID + " for device with udid: " + device.UDID)
+	}
+}
@@ -0,0 +1,186 @@
+package device
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statsInterval = 5 * time.Second
+	// 5 minutes of history with the default interval
+	statsHistoryLength = 60
+)
+
+// Resource usage of a container at a point in time
+type StatsSample struct {
+	// Unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+	// Percentage of a single CPU like `docker stats`, can go over 100 on multiple CPUs
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryUsage   uint64  `json:"memory_usage"`
+	MemoryLimit   uint64  `json:"memory_limit"`
+	MemoryPercent float64 `json:"memory_percent"`
+	NetworkRx     uint64  `json:"network_rx"`
+	NetworkTx     uint64  `json:"network_tx"`
+}
+
+// Current resource usage of a device container and its recent history, oldest sample first
+type DeviceStats struct {
+	UDID          string        `json:"udid"`
+	ContainerID   string        `json:"container_id"`
+	ContainerName string        `json:"container_name"`
+	RestartCount  int           `json:"restart_count"`
+	Current       *StatsSample  `json:"current,omitempty"`
+	History       []StatsSample `json:"history"`
+}
+
+type containerStatsHistory struct {
+	stats DeviceStats
+	// Last raw counters to calculate the CPU usage of the next sample
+	last ContainerStats
+}
+
+var (
+	statsMu      sync.Mutex
+	statsHistory = make(map[string]*containerStatsHistory)
+)
+
+// Periodically sample the resource usage of the device containers
+func collectContainerStats() {
+	for {
+		sampleContainerStats()
+		time.Sleep(statsInterval)
+	}
+}
+
+func sampleContainerStats() {
+	// Take a snapshot of the containers so the runtime calls do not block the device updates
+	configMu.Lock()
+	var containers []DeviceStats
+	for _, device := range Config.Devices {
+		if device.Container != nil {
+			containers = append(containers, DeviceStats{
+				UDID:          device.UDID,
+				ContainerID:   device.Container.ContainerID,
+				ContainerName: device.Container.ContainerName,
+			})
+		}
+	}
+	configMu.Unlock()
+
+	current := make(map[string]bool)
+	for _, container := range containers {
+		current[container.ContainerID] = true
+
+		ctx, cancel := context.WithTimeout(context.Background(), statsInterval)
+		stats, err := runtimeForContainer(container.ContainerID).Stats(ctx, container.ContainerID)
+		cancel()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "container_stats",
+			}).Debug("Could not get stats for container with ID: " + container.ContainerID + ": " + err.Error())
+			continue
+		}
+
+		statsMu.Lock()
+		history, ok := statsHistory[container.ContainerID]
+		if !ok {
+			history = &containerStatsHistory{stats: container}
+			statsHistory[container.ContainerID] = history
+		}
+		history.add(stats, time.Now())
+		statsMu.Unlock()
+	}
+
+	// Forget the history of containers that were removed
+	statsMu.Lock()
+	for containerID := range statsHistory {
+		if !current[containerID] {
+			delete(statsHistory, containerID)
+		}
+	}
+	statsMu.Unlock()
+}
+
+// Add a sample calculated from the raw counters, the CPU usage of the first sample is 0
+// Should be called with statsMu held
+func (history *containerStatsHistory) add(stats ContainerStats, now time.Time) {
+	sample := StatsSample{
+		Timestamp:   now.UnixMilli(),
+		MemoryUsage: stats.MemoryUsage,
+		MemoryLimit: stats.MemoryLimit,
+		NetworkRx:   stats.NetworkRx,
+		NetworkTx:   stats.NetworkTx,
+	}
+	if stats.MemoryLimit > 0 {
+		sample.MemoryPercent = float64(stats.MemoryUsage) / float64(stats.MemoryLimit) * 100
+	}
+	if history.stats.Current != nil && stats.CPUTotalNs >= history.last.CPUTotalNs && stats.SystemCPUNs > history.last.SystemCPUNs {
+		cpuDelta := float64(stats.CPUTotalNs - history.last.CPUTotalNs)
+		systemDelta := float64(stats.SystemCPUNs - history.last.SystemCPUNs)
+		sample.CPUPercent = cpuDelta / systemDelta * float64(stats.OnlineCPUs) * 100
+	}
+
+	history.last = stats
+	history.stats.Current = &sample
+	history.stats.History = append(history.stats.History, sample)
+	if len(history.stats.History) > statsHistoryLength {
+		history.stats.History = history.stats.History[len(history.stats.History)-statsHistoryLength:]
+	}
+}
+
+// Copy of the stats that is safe to use after statsMu is released
+func (history *containerStatsHistory) snapshot() DeviceStats {
+	stats := history.stats
+	stats.RestartCount = lifecycles.get(stats.UDID).RestartCount()
+	stats.History = append([]StatsSample{}, history.stats.History...)
+	if history.stats.Current != nil {
+		current := *history.stats.Current
+		stats.Current = &current
+	}
+	return stats
+}
+
+// Get the resource usage of the container of a device
+func GetDeviceStats(udid string) (DeviceStats, error) {
+	containerID, err := GetDeviceContainerID(udid)
+	if err != nil {
+		return DeviceStats{}, err
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	history, ok := statsHistory[containerID]
+	if !ok {
+		// The container was created after the last sample
+		return DeviceStats{UDID: udid, ContainerID: containerID, RestartCount: lifecycles.get(udid).RestartCount(), History: []StatsSample{}}, nil
+	}
+	return history.snapshot(), nil
+}
+
+// Get the resource usage of all device containers
+func GetContainersStats() []DeviceStats {
+	configMu.Lock()
+	var containerIDs []string
+	for _, device := range Config.Devices {
+		if device.Container != nil {
+			containerIDs = append(containerIDs, device.Container.ContainerID)
+		}
+	}
+	configMu.Unlock()
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	allStats := []DeviceStats{}
+	for _, containerID := range containerIDs {
+		if history, ok := statsHistory[containerID]; ok {
+			allStats = append(allStats, history.snapshot())
+		}
+	}
+	return allStats
+}
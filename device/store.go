@@ -0,0 +1,180 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var ErrStoreDeviceNotFound = errors.New("device not found in store")
+
+// Persists the devices state so it can be shared with GADS
+type DeviceStore interface {
+	// Insert a device document or replace the existing one with the same UDID
+	Insert(device *Device) error
+	// Update only the provided fields of an existing device document
+	// Does nothing if the device is not in the store
+	Update(udid string, fields map[string]interface{}) error
+	// Get a device document by UDID
+	Get(udid string) (*Device, error)
+	// List all device documents
+	List() ([]*Device, error)
+	// Delete a device document by UDID
+	Delete(udid string) error
+	// Get a channel receiving all device documents changes until Close is called
+	Watch() (<-chan DeviceChange, error)
+	// Record a device state transition
+	InsertEvent(event DeviceEvent) error
+	// List the device state transitions matching the filter ordered by timestamp
+	ListEvents(filter EventFilter) ([]DeviceEvent, error)
+	// Get the connectivity state of the store
+	Status() StoreStatus
+	Close() error
+}
+
+// The connectivity state of a device store
+type StoreStatus struct {
+	Backend   string `json:"backend"`
+	Connected bool   `json:"connected"`
+	// Unix timestamp in milliseconds of the last connectivity change
+	Since             int64  `json:"since"`
+	LastError         string `json:"last_error,omitempty"`
+	ReconnectAttempts int    `json:"reconnect_attempts"`
+	PendingWrites     int    `json:"pending_writes"`
+}
+
+// A change of a device document, OldValue is nil on insert and NewValue is nil on delete
+type DeviceChange struct {
+	OldValue *Device `json:"old_val"`
+	NewValue *Device `json:"new_val"`
+}
+
+var store DeviceStore
+
+// Create the device store selected in env-config
+func newDeviceStore() (DeviceStore, error) {
+	switch Config.EnvConfig.DeviceStore {
+	case "", "rethinkdb":
+		return newRethinkStore(Config.EnvConfig.RethinkDB)
+	case "memory":
+		return newMemoryStore(), nil
+	case "bolt":
+		path := Config.EnvConfig.DeviceStorePath
+		if path == "" {
+			path = defaultBoltStorePath
+		}
+		return newBoltStore(path)
+	default:
+		return nil, errors.New("Unsupported device store: " + Config.EnvConfig.DeviceStore)
+	}
+}
+
+// Get a deep enough copy of the device so the store does not share state with the running device
+func (device *Device) clone() *Device {
+	deviceCopy := *device
+	if device.Container != nil {
+		containerCopy := *device.Container
+		deviceCopy.Container = &containerCopy
+	}
+	if device.Quarantine != nil {
+		quarantineCopy := *device.Quarantine
+		deviceCopy.Quarantine = &quarantineCopy
+	}
+	if device.Health != nil {
+		healthCopy := *device.Health
+		healthCopy.Components = append([]ComponentHealth{}, device.Health.Components...)
+		deviceCopy.Health = &healthCopy
+	}
+	if device.HealthState != nil {
+		healthStateCopy := *device.HealthState
+		deviceCopy.HealthState = &healthStateCopy
+	}
+	deviceCopy.healthTransitions = nil
+	deviceCopy.ContainerConfig = device.ContainerConfig.clone()
+	return &deviceCopy
+}
+
+// Convert the device to a document map with the same keys as its JSON representation
+func deviceDocument(device *Device) (map[string]interface{}, error) {
+	bs, err := json.Marshal(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]interface{}
+	err = json.Unmarshal(bs, &document)
+	if err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// Get a copy of the device with the provided fields applied on top of it
+func mergeDeviceFields(device *Device, fields map[string]interface{}) (*Device, error) {
+	document, err := deviceDocument(device)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range fields {
+		document[key] = value
+	}
+
+	bs, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged Device
+	err = json.Unmarshal(bs, &merged)
+	if err != nil {
+		return nil, err
+	}
+	return &merged, nil
+}
+
+// Fan out device changes to the watchers of the in-process stores
+type changeFeed struct {
+	mu       sync.Mutex
+	watchers []chan DeviceChange
+	closed   bool
+}
+
+func (feed *changeFeed) watch() (<-chan DeviceChange, error) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	if feed.closed {
+		return nil, errors.New("store is closed")
+	}
+
+	watcher := make(chan DeviceChange, 100)
+	feed.watchers = append(feed.watchers, watcher)
+	return watcher, nil
+}
+
+// Send the change to all watchers, slow watchers miss changes instead of blocking the store
+func (feed *changeFeed) publish(change DeviceChange) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	for _, watcher := range feed.watchers {
+		select {
+		case watcher <- change:
+		default:
+		}
+	}
+}
+
+func (feed *changeFeed) close() {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	if feed.closed {
+		return
+	}
+	feed.closed = true
+	for _, watcher := range feed.watchers {
+		close(watcher)
+	}
+	feed.watchers = nil
+}
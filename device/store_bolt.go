@@ -0,0 +1,263 @@
+package device
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultBoltStorePath = "./devices.db"
+
+var (
+	boltDevicesBucket = []byte("devices")
+	boltEventsBucket  = []byte("device_events")
+)
+
+// Embedded file-based device store backed by BoltDB
+// The state survives provider restarts without running a database server
+type boltStore struct {
+	db      *bolt.DB
+	feed    changeFeed
+	created time.Time
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltDevicesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltEventsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db, created: time.Now()}, nil
+}
+
+func (s *boltStore) Insert(device *Device) error {
+	newValue := device.clone()
+	bs, err := json.Marshal(newValue)
+	if err != nil {
+		return err
+	}
+
+	var oldValue *Device
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDevicesBucket)
+		existing := bucket.Get([]byte(device.UDID))
+		if existing != nil {
+			oldValue = &Device{}
+			if err := json.Unmarshal(existing, oldValue); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(device.UDID), bs)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.feed.publish(DeviceChange{OldValue: oldValue, NewValue: newValue})
+	return nil
+}
+
+func (s *boltStore) Update(udid string, fields map[string]interface{}) error {
+	var oldValue, newValue *Device
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDevicesBucket)
+		existing := bucket.Get([]byte(udid))
+		if existing == nil {
+			return nil
+		}
+
+		oldValue = &Device{}
+		if err := json.Unmarshal(existing, oldValue); err != nil {
+			return err
+		}
+
+		var err error
+		newValue, err = mergeDeviceFields(oldValue, fields)
+		if err != nil {
+			return err
+		}
+
+		bs, err := json.Marshal(newValue)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(udid), bs)
+	})
+	if err != nil {
+		return err
+	}
+
+	if newValue != nil {
+		s.feed.publish(DeviceChange{OldValue: oldValue, NewValue: newValue})
+	}
+	return nil
+}
+
+func (s *boltStore) Get(udid string) (*Device, error) {
+	var device *Device
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bs := tx.Bucket(boltDevicesBucket).Get([]byte(udid))
+		if bs == nil {
+			return ErrStoreDeviceNotFound
+		}
+		device = &Device{}
+		return json.Unmarshal(bs, device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (s *boltStore) List() ([]*Device, error) {
+	var devices []*Device
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDevicesBucket).ForEach(func(k, v []byte) error {
+			device := &Device{}
+			if err := json.Unmarshal(v, device); err != nil {
+				return err
+			}
+			devices = append(devices, device)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (s *boltStore) Delete(udid string) error {
+	var oldValue *Device
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDevicesBucket)
+		existing := bucket.Get([]byte(udid))
+		if existing == nil {
+			return nil
+		}
+		oldValue = &Device{}
+		if err := json.Unmarshal(existing, oldValue); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(udid))
+	})
+	if err != nil {
+		return err
+	}
+
+	if oldValue != nil {
+		s.feed.publish(DeviceChange{OldValue: oldValue})
+	}
+	return nil
+}
+
+func (s *boltStore) Watch() (<-chan DeviceChange, error) {
+	return s.feed.watch()
+}
+
+// Events are kept in a nested bucket per device with keys ordered by timestamp
+func (s *boltStore) InsertEvent(event DeviceEvent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		deviceBucket, err := tx.Bucket(boltEventsBucket).CreateBucketIfNotExists([]byte(event.UDID))
+		if err != nil {
+			return err
+		}
+
+		sequence, err := deviceBucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key[:8], uint64(event.Timestamp))
+		binary.BigEndian.PutUint64(key[8:], sequence)
+		event.ID = strconv.FormatUint(sequence, 10)
+
+		bs, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		err = deviceBucket.Put(key, bs)
+		if err != nil {
+			return err
+		}
+
+		// Drop the oldest events above the per device limit
+		count := 0
+		cursor := deviceBucket.Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			count++
+		}
+		excess := count - maxEventsPerDevice
+		for k, _ := cursor.First(); k != nil && excess > 0; k, _ = cursor.Next() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			excess--
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) ListEvents(filter EventFilter) ([]DeviceEvent, error) {
+	var events []DeviceEvent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		eventsBucket := tx.Bucket(boltEventsBucket)
+		return eventsBucket.ForEach(func(udid, _ []byte) error {
+			if filter.UDID != "" && string(udid) != filter.UDID {
+				return nil
+			}
+
+			start := make([]byte, 8)
+			binary.BigEndian.PutUint64(start, uint64(filter.Since))
+			cursor := eventsBucket.Bucket(udid).Cursor()
+			for k, v := cursor.Seek(start); k != nil; k, v = cursor.Next() {
+				var event DeviceEvent
+				if err := json.Unmarshal(v, &event); err != nil {
+					return err
+				}
+				if filter.matches(event) {
+					events = append(events, event)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+	return events, nil
+}
+
+func (s *boltStore) Status() StoreStatus {
+	return StoreStatus{
+		Backend:   "bolt",
+		Connected: true,
+		Since:     s.created.UnixMilli(),
+	}
+}
+
+func (s *boltStore) Close() error {
+	s.feed.close()
+	return s.db.Close()
+}
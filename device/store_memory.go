@@ -0,0 +1,147 @@
+package device
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// In-memory device store, the state is lost when the provider stops
+// Useful for running a provider standalone without a database
+type memoryStore struct {
+	mu          sync.RWMutex
+	devices     map[string]*Device
+	events      map[string][]DeviceEvent
+	lastEventID int
+	feed        changeFeed
+	created     time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		devices: make(map[string]*Device),
+		events:  make(map[string][]DeviceEvent),
+		created: time.Now(),
+	}
+}
+
+func (s *memoryStore) Insert(device *Device) error {
+	s.mu.Lock()
+	oldValue := s.devices[device.UDID]
+	newValue := device.clone()
+	s.devices[device.UDID] = newValue
+	s.mu.Unlock()
+
+	s.feed.publish(DeviceChange{OldValue: oldValue, NewValue: newValue.clone()})
+	return nil
+}
+
+func (s *memoryStore) Update(udid string, fields map[string]interface{}) error {
+	s.mu.Lock()
+	oldValue, ok := s.devices[udid]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	newValue, err := mergeDeviceFields(oldValue, fields)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.devices[udid] = newValue
+	s.mu.Unlock()
+
+	s.feed.publish(DeviceChange{OldValue: oldValue, NewValue: newValue.clone()})
+	return nil
+}
+
+func (s *memoryStore) Get(udid string) (*Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	device, ok := s.devices[udid]
+	if !ok {
+		return nil, ErrStoreDeviceNotFound
+	}
+	return device.clone(), nil
+}
+
+func (s *memoryStore) List() ([]*Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var devices []*Device
+	for _, device := range s.devices {
+		devices = append(devices, device.clone())
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].UDID < devices[j].UDID
+	})
+	return devices, nil
+}
+
+func (s *memoryStore) Delete(udid string) error {
+	s.mu.Lock()
+	oldValue, ok := s.devices[udid]
+	delete(s.devices, udid)
+	s.mu.Unlock()
+
+	if ok {
+		s.feed.publish(DeviceChange{OldValue: oldValue})
+	}
+	return nil
+}
+
+func (s *memoryStore) Watch() (<-chan DeviceChange, error) {
+	return s.feed.watch()
+}
+
+func (s *memoryStore) InsertEvent(event DeviceEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastEventID++
+	event.ID = strconv.Itoa(s.lastEventID)
+
+	events := append(s.events[event.UDID], event)
+	if len(events) > maxEventsPerDevice {
+		events = events[len(events)-maxEventsPerDevice:]
+	}
+	s.events[event.UDID] = events
+	return nil
+}
+
+func (s *memoryStore) ListEvents(filter EventFilter) ([]DeviceEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []DeviceEvent
+	for udid, deviceEvents := range s.events {
+		if filter.UDID != "" && udid != filter.UDID {
+			continue
+		}
+		for _, event := range deviceEvents {
+			if filter.matches(event) {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+	return events, nil
+}
+
+func (s *memoryStore) Status() StoreStatus {
+	return StoreStatus{
+		Backend:   "memory",
+		Connected: true,
+		Since:     s.created.UnixMilli(),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	s.feed.close()
+	return nil
+}
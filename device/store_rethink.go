@@ -0,0 +1,542 @@
+package device
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 1 * time.Minute
+	// Maximum number of events buffered while the DB is unreachable
+	maxPendingEvents = 10000
+)
+
+var errStoreDisconnected = errors.New("device store is disconnected")
+
+// A write waiting for the DB connection to come back
+type pendingWrite struct {
+	op       string
+	document map[string]interface{}
+}
+
+// Device store backed by the RethinkDB instance shared with GADS
+// Writes are coalesced per device while the DB is unreachable and flushed on reconnect
+type rethinkStore struct {
+	address string
+
+	mu                sync.Mutex
+	session           *r.Session
+	connected         bool
+	since             time.Time
+	lastError         string
+	reconnectAttempts int
+	pending           map[string]pendingWrite
+	pendingEvents     []DeviceEvent
+
+	done chan struct{}
+}
+
+// Create the RethinkDB store, if the DB is not reachable it keeps reconnecting in the background
+func newRethinkStore(address string) (*rethinkStore, error) {
+	s := &rethinkStore{
+		address: address,
+		since:   time.Now(),
+		pending: make(map[string]pendingWrite),
+		done:    make(chan struct{}),
+	}
+
+	err := s.connect()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "db_connect",
+		}).Error("Could not make initial connection to RethinkDB on " + address + ", will keep retrying: " + err.Error())
+		s.lastError = err.Error()
+	} else {
+		s.connected = true
+		s.ensureSchema(s.session)
+	}
+
+	go s.connectionLoop()
+
+	return s, nil
+}
+
+// Connect to the DB or reconnect the existing session
+func (s *rethinkStore) connect() error {
+	s.mu.Lock()
+	session := s.session
+	s.mu.Unlock()
+
+	if session != nil {
+		return session.Reconnect()
+	}
+
+	session, err := r.Connect(r.ConnectOpts{
+		Address:  s.address,
+		Database: rethinkDatabase,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.session = session
+	s.mu.Unlock()
+	return nil
+}
+
+// Check if the DB connection is alive and reconnect with exponential backoff and jitter if not
+func (s *rethinkStore) connectionLoop() {
+	backoff := minReconnectBackoff
+	for {
+		s.mu.Lock()
+		connected := s.connected
+		session := s.session
+		s.mu.Unlock()
+
+		if connected && session.IsConnected() {
+			backoff = minReconnectBackoff
+			if !s.wait(2 * time.Second) {
+				return
+			}
+			continue
+		}
+
+		if connected {
+			s.setDisconnected(errors.New("connection lost"))
+		}
+
+		err := s.connect()
+		if err == nil {
+			s.mu.Lock()
+			session := s.session
+			s.mu.Unlock()
+
+			s.ensureSchema(session)
+			err = s.flushPending(func(udid string, write pendingWrite) error {
+				return execWrite(session, udid, write)
+			}, func(event DeviceEvent) error {
+				return r.Table(rethinkEvents).Insert(event).Exec(session)
+			})
+			if err == nil {
+				continue
+			}
+			// A failed flush is handled like a failed reconnect so it is retried with backoff
+			err = errors.New("flushing the pending writes failed: " + err.Error())
+		}
+
+		s.mu.Lock()
+		s.reconnectAttempts++
+		s.lastError = err.Error()
+		attempts := s.reconnectAttempts
+		s.mu.Unlock()
+
+		// Full jitter keeps many providers from hammering the DB at the same time
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.WithFields(log.Fields{
+			"event": "db_reconnect",
+		}).Warn("Could not reconnect to RethinkDB (attempt " + strconv.Itoa(attempts) + "), retrying in " + delay.Round(time.Millisecond).String() + ": " + err.Error())
+
+		if !s.wait(delay) {
+			return
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// Wait for the provided duration, returns false if the store was closed meanwhile
+func (s *rethinkStore) wait(duration time.Duration) bool {
+	select {
+	case <-s.done:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+// Should be called with s.mu held
+func (s *rethinkStore) setConnectedLocked() {
+	s.connected = true
+	s.since = time.Now()
+	s.reconnectAttempts = 0
+	s.lastError = ""
+
+	log.WithFields(log.Fields{
+		"event": "db_reconnect",
+	}).Info("Connected to RethinkDB on " + s.address)
+}
+
+func (s *rethinkStore) setDisconnected(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setDisconnectedLocked(err)
+}
+
+func (s *rethinkStore) setDisconnectedLocked(err error) {
+	if !s.connected {
+		return
+	}
+	s.connected = false
+	s.since = time.Now()
+	s.lastError = err.Error()
+
+	log.WithFields(log.Fields{
+		"event": "db_disconnect",
+	}).Error("Lost connection to RethinkDB on " + s.address + ", device writes will be buffered: " + err.Error())
+}
+
+// Buffer a write for a device, only the latest state of each device is kept
+func (s *rethinkStore) bufferLocked(udid string, write pendingWrite) {
+	existing, ok := s.pending[udid]
+	if ok && write.op == "update" {
+		switch existing.op {
+		case "insert", "update":
+			// Apply the changed fields on top of the pending document
+			for key, value := range write.document {
+				existing.document[key] = value
+			}
+			return
+		case "delete":
+			// Updating a deleted device does nothing
+			return
+		}
+	}
+	s.pending[udid] = write
+}
+
+// Put back a buffered write that could not be flushed without overriding the writes buffered after it
+// Should be called with s.mu held
+func (s *rethinkStore) requeueLocked(udid string, write pendingWrite) {
+	newer, ok := s.pending[udid]
+	if !ok {
+		s.pending[udid] = write
+		return
+	}
+	// Newer inserts and deletes replace the whole document
+	if newer.op != "update" {
+		return
+	}
+	// Updating a deleted device does nothing
+	if write.op == "delete" {
+		s.pending[udid] = write
+		return
+	}
+	// Newer updates are applied on top of the older write
+	document := make(map[string]interface{})
+	for key, value := range write.document {
+		document[key] = value
+	}
+	for key, value := range newer.document {
+		document[key] = value
+	}
+	s.pending[udid] = pendingWrite{op: write.op, document: document}
+}
+
+// Write the buffered device states and events to the DB through the reconnected session
+// The store is marked connected only once the buffer is drained, so writes made meanwhile are buffered
+// and cannot be overwritten by older buffered writes
+// A failed write is treated as a lost connection, the writes that were not flushed are buffered again
+func (s *rethinkStore) flushPending(writeDevice func(udid string, write pendingWrite) error, writeEvent func(event DeviceEvent) error) error {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 && len(s.pendingEvents) == 0 {
+			s.setConnectedLocked()
+			s.mu.Unlock()
+			return nil
+		}
+		pending := s.pending
+		s.pending = make(map[string]pendingWrite)
+		pendingEvents := s.pendingEvents
+		s.pendingEvents = nil
+		s.mu.Unlock()
+
+		log.WithFields(log.Fields{
+			"event": "db_flush",
+		}).Info("Flushing " + strconv.Itoa(len(pending)) + " pending device writes and " + strconv.Itoa(len(pendingEvents)) + " pending events")
+
+		for udid, write := range pending {
+			err := writeDevice(udid, write)
+			if err != nil {
+				s.requeue(pending, pendingEvents)
+				return err
+			}
+			delete(pending, udid)
+		}
+
+		for i, event := range pendingEvents {
+			err := writeEvent(event)
+			if err != nil {
+				s.requeue(nil, pendingEvents[i:])
+				return err
+			}
+		}
+	}
+}
+
+// Put back the writes and events that were not flushed before the ones buffered meanwhile
+func (s *rethinkStore) requeue(pending map[string]pendingWrite, pendingEvents []DeviceEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for udid, write := range pending {
+		s.requeueLocked(udid, write)
+	}
+	s.pendingEvents = append(append([]DeviceEvent{}, pendingEvents...), s.pendingEvents...)
+	if len(s.pendingEvents) > maxPendingEvents {
+		s.pendingEvents = s.pendingEvents[len(s.pendingEvents)-maxPendingEvents:]
+	}
+}
+
+// Bootstrap the gads database schema, failures are logged and retried on the next reconnect
+func (s *rethinkStore) ensureSchema(session *r.Session) {
+	err := bootstrapSchema(session)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "db_migration",
+		}).Error("Could not bootstrap the " + rethinkDatabase + " database schema: " + err.Error())
+	}
+}
+
+// Execute a write or buffer it if the DB is not reachable
+func (s *rethinkStore) write(udid string, write pendingWrite) error {
+	s.mu.Lock()
+	if !s.connected {
+		s.bufferLocked(udid, write)
+		s.mu.Unlock()
+		return nil
+	}
+	session := s.session
+	s.mu.Unlock()
+
+	err := execWrite(session, udid, write)
+
+	// Buffer the write if it failed because the connection dropped
+	if err != nil && !session.IsConnected() {
+		s.mu.Lock()
+		s.setDisconnectedLocked(err)
+		s.bufferLocked(udid, write)
+		s.mu.Unlock()
+		return nil
+	}
+
+	return err
+}
+
+func execWrite(session *r.Session, udid string, write pendingWrite) error {
+	switch write.op {
+	case "insert":
+		return r.Table(rethinkDevices).Insert(write.document, r.InsertOpts{Conflict: "update"}).Exec(session)
+	case "update":
+		return r.Table(rethinkDevices).Get(udid).Update(write.document).Exec(session)
+	case "delete":
+		return r.Table(rethinkDevices).Get(udid).Delete().Exec(session)
+	}
+	return nil
+}
+
+// Get the session if the DB is connected
+func (s *rethinkStore) connectedSession() (*r.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.connected {
+		return nil, errStoreDisconnected
+	}
+	return s.session, nil
+}
+
+func (s *rethinkStore) Insert(device *Device) error {
+	document, err := deviceDocument(device)
+	if err != nil {
+		return err
+	}
+	return s.write(device.UDID, pendingWrite{op: "insert", document: document})
+}
+
+func (s *rethinkStore) Update(udid string, fields map[string]interface{}) error {
+	// Copy the fields since they might be merged into later buffered writes
+	document := make(map[string]interface{})
+	for key, value := range fields {
+		document[key] = value
+	}
+	return s.write(udid, pendingWrite{op: "update", document: document})
+}
+
+func (s *rethinkStore) Get(udid string) (*Device, error) {
+	session, err := s.connectedSession()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := r.Table(rethinkDevices).Get(udid).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, ErrStoreDeviceNotFound
+	}
+
+	var device Device
+	err = cursor.One(&device)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (s *rethinkStore) List() ([]*Device, error) {
+	session, err := s.connectedSession()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := r.Table(rethinkDevices).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var devices []*Device
+	err = cursor.All(&devices)
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (s *rethinkStore) Delete(udid string) error {
+	return s.write(udid, pendingWrite{op: "delete"})
+}
+
+// Watch the devices table through a RethinkDB changefeed
+// The channel is closed if the connection drops and Watch has to be called again
+func (s *rethinkStore) Watch() (<-chan DeviceChange, error) {
+	session, err := s.connectedSession()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := r.Table(rethinkDevices).Changes().Run(session)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan DeviceChange, 100)
+	go func() {
+		defer close(changes)
+		defer cursor.Close()
+
+		var change DeviceChange
+		for cursor.Next(&change) {
+			select {
+			case changes <- change:
+			case <-s.done:
+				return
+			}
+			change = DeviceChange{}
+		}
+	}()
+
+	return changes, nil
+}
+
+// Events are buffered while the DB is unreachable, the oldest ones are dropped above the limit
+func (s *rethinkStore) InsertEvent(event DeviceEvent) error {
+	s.mu.Lock()
+	if !s.connected {
+		s.pendingEvents = append(s.pendingEvents, event)
+		if len(s.pendingEvents) > maxPendingEvents {
+			s.pendingEvents = s.pendingEvents[len(s.pendingEvents)-maxPendingEvents:]
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	session := s.session
+	s.mu.Unlock()
+
+	err := r.Table(rethinkEvents).Insert(event).Exec(session)
+	if err != nil && !session.IsConnected() {
+		s.mu.Lock()
+		s.setDisconnectedLocked(err)
+		s.pendingEvents = append(s.pendingEvents, event)
+		s.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+func (s *rethinkStore) ListEvents(filter EventFilter) ([]DeviceEvent, error) {
+	session, err := s.connectedSession()
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the secondary indexes created by the schema migrations to avoid full table scans
+	var query r.Term
+	if filter.UDID != "" {
+		query = r.Table(rethinkEvents).
+			Between([]interface{}{filter.UDID, filter.Since}, []interface{}{filter.UDID, r.MaxVal}, r.BetweenOpts{Index: rethinkEventsUDID}).
+			OrderBy(r.OrderByOpts{Index: rethinkEventsUDID})
+	} else {
+		query = r.Table(rethinkEvents).
+			Between(filter.Since, r.MaxVal, r.BetweenOpts{Index: "timestamp"}).
+			OrderBy(r.OrderByOpts{Index: "timestamp"})
+	}
+	if filter.Type != "" {
+		query = query.Filter(func(event r.Term) r.Term {
+			return event.Field("type").Eq(filter.Type)
+		})
+	}
+
+	cursor, err := query.Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var events []DeviceEvent
+	err = cursor.All(&events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *rethinkStore) Status() StoreStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return StoreStatus{
+		Backend:           "rethinkdb",
+		Connected:         s.connected,
+		Since:             s.since.UnixMilli(),
+		LastError:         s.lastError,
+		ReconnectAttempts: s.reconnectAttempts,
+		PendingWrites:     len(s.pending),
+	}
+}
+
+func (s *rethinkStore) Close() error {
+	close(s.done)
+
+	s.mu.Lock()
+	session := s.session
+	s.mu.Unlock()
+
+	if session == nil {
+		return nil
+	}
+	return session.Close()
+}
@@ -0,0 +1,195 @@
+package device
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+const (
+	rethinkDatabase   = "gads"
+	rethinkMetaTable  = "meta"
+	rethinkDevices    = "devices"
+	rethinkEvents     = "device_events"
+	rethinkEventsUDID = "udid_timestamp"
+)
+
+// A versioned change of the gads database schema
+type schemaMigration struct {
+	version     int
+	description string
+	apply       func(session *r.Session) error
+}
+
+// An applied migration recorded in the meta table
+type appliedMigration struct {
+	ID          int    `rethinkdb:"id"`
+	Description string `rethinkdb:"description"`
+	AppliedAt   int64  `rethinkdb:"applied_at"`
+}
+
+// The migrations are applied in order and each of them is idempotent
+// so a partially applied migration can be safely retried
+var schemaMigrations = []schemaMigration{
+	{
+		version:     1,
+		description: "create devices table",
+		apply: func(session *r.Session) error {
+			return ensureTable(session, rethinkDevices, "udid")
+		},
+	},
+	{
+		version:     2,
+		description: "create device_events table with indexes",
+		apply: func(session *r.Session) error {
+			err := ensureTable(session, rethinkEvents, "id")
+			if err != nil {
+				return err
+			}
+
+			err = ensureIndex(session, rethinkEvents, "timestamp", func(event r.Term) interface{} {
+				return event.Field("timestamp")
+			})
+			if err != nil {
+				return err
+			}
+
+			return ensureIndex(session, rethinkEvents, rethinkEventsUDID, func(event r.Term) interface{} {
+				return []interface{}{event.Field("udid"), event.Field("timestamp")}
+			})
+		},
+	},
+	{
+		version:     3,
+		description: "create devices host index",
+		apply: func(session *r.Session) error {
+			return ensureIndex(session, rethinkDevices, "host", func(device r.Term) interface{} {
+				return device.Field("host")
+			})
+		},
+	},
+}
+
+// Create the gads database and the meta table if needed and apply the pending migrations
+func bootstrapSchema(session *r.Session) error {
+	err := ensureDatabase(session)
+	if err != nil {
+		return err
+	}
+
+	err = ensureTable(session, rethinkMetaTable, "id")
+	if err != nil {
+		return err
+	}
+
+	cursor, err := r.DB(rethinkDatabase).Table(rethinkMetaTable).Run(session)
+	if err != nil {
+		return err
+	}
+	var applied []appliedMigration
+	err = cursor.All(&applied)
+	cursor.Close()
+	if err != nil {
+		return err
+	}
+
+	appliedVersions := make(map[int]bool)
+	for _, migration := range applied {
+		appliedVersions[migration.ID] = true
+	}
+
+	for _, migration := range schemaMigrations {
+		if appliedVersions[migration.version] {
+			continue
+		}
+
+		err = migration.apply(session)
+		if err != nil {
+			return err
+		}
+
+		// Another provider might have applied the same migration meanwhile, ignore the conflict
+		err = r.DB(rethinkDatabase).Table(rethinkMetaTable).Insert(appliedMigration{
+			ID:          migration.version,
+			Description: migration.description,
+			AppliedAt:   time.Now().UnixMilli(),
+		}, r.InsertOpts{Conflict: "replace"}).Exec(session)
+		if err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"event": "db_migration",
+		}).Info("Applied DB migration " + strconv.Itoa(migration.version) + ": " + migration.description)
+	}
+
+	return nil
+}
+
+// Create the gads database if it does not exist
+func ensureDatabase(session *r.Session) error {
+	exists, err := containsValue(session, r.DBList(), rethinkDatabase)
+	if err != nil || exists {
+		return err
+	}
+
+	err = r.DBCreate(rethinkDatabase).Exec(session)
+	if err != nil && !isAlreadyExistsError(err) {
+		return err
+	}
+	return nil
+}
+
+// Create a table in the gads database if it does not exist
+func ensureTable(session *r.Session, table string, primaryKey string) error {
+	exists, err := containsValue(session, r.DB(rethinkDatabase).TableList(), table)
+	if err != nil || exists {
+		return err
+	}
+
+	err = r.DB(rethinkDatabase).TableCreate(table, r.TableCreateOpts{PrimaryKey: primaryKey}).Exec(session)
+	if err != nil && !isAlreadyExistsError(err) {
+		return err
+	}
+
+	return r.DB(rethinkDatabase).Table(table).Wait().Exec(session)
+}
+
+// Create a secondary index if it does not exist and wait for it to be ready
+func ensureIndex(session *r.Session, table string, index string, indexFunction func(r.Term) interface{}) error {
+	exists, err := containsValue(session, r.DB(rethinkDatabase).Table(table).IndexList(), index)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		err = r.DB(rethinkDatabase).Table(table).IndexCreateFunc(index, indexFunction).Exec(session)
+		if err != nil && !isAlreadyExistsError(err) {
+			return err
+		}
+	}
+
+	return r.DB(rethinkDatabase).Table(table).IndexWait(index).Exec(session)
+}
+
+// Check if the list returned by the query contains the value
+func containsValue(session *r.Session, list r.Term, value string) (bool, error) {
+	cursor, err := list.Contains(value).Run(session)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+
+	var contains bool
+	err = cursor.One(&contains)
+	return contains, err
+}
+
+// Check if a create query failed only because another provider already created the object
+func isAlreadyExistsError(err error) bool {
+	_, ok := err.(r.RQLOpFailedError)
+	return ok && strings.Contains(err.Error(), "already exists")
+}
@@ -0,0 +1,173 @@
+package device
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// RethinkDB store that never connected, so all writes are buffered
+func newDisconnectedRethinkStore() *rethinkStore {
+	return &rethinkStore{
+		address: "localhost:28015",
+		since:   time.Now(),
+		pending: make(map[string]pendingWrite),
+		done:    make(chan struct{}),
+	}
+}
+
+func TestRethinkStoreBuffersWritesWhileDisconnected(t *testing.T) {
+	s := newDisconnectedRethinkStore()
+
+	s.Insert(newTestDevice("udid1", true))
+	s.Update("udid1", map[string]interface{}{"connected": false})
+	s.Update("udid1", map[string]interface{}{"name": "renamed"})
+	s.Insert(newTestDevice("udid2", true))
+	s.Delete("udid2")
+	s.Update("udid2", map[string]interface{}{"name": "renamed"})
+	s.Update("udid3", map[string]interface{}{"connected": true})
+	s.Update("udid3", map[string]interface{}{"name": "renamed"})
+
+	if pending := s.Status().PendingWrites; pending != 3 {
+		t.Fatalf("expected 3 pending writes coalesced per device, got %d", pending)
+	}
+
+	// Updates are applied on top of the buffered insert
+	udid1 := s.pending["udid1"]
+	if udid1.op != "insert" || udid1.document["connected"] != false || udid1.document["name"] != "renamed" || udid1.document["model"] != "Pixel" {
+		t.Errorf("expected an insert with the updated fields, got %+v", udid1)
+	}
+	// Updates of a deleted device are dropped
+	if udid2 := s.pending["udid2"]; udid2.op != "delete" {
+		t.Errorf("expected a delete, got %+v", udid2)
+	}
+	// Updates are merged
+	expected := pendingWrite{op: "update", document: map[string]interface{}{"connected": true, "name": "renamed"}}
+	if udid3 := s.pending["udid3"]; !reflect.DeepEqual(udid3, expected) {
+		t.Errorf("expected the merged update %+v, got %+v", expected, udid3)
+	}
+}
+
+func TestRethinkStoreUpdateCopiesFields(t *testing.T) {
+	s := newDisconnectedRethinkStore()
+
+	fields := map[string]interface{}{"name": "renamed"}
+	s.Update("udid1", fields)
+	fields["name"] = "changed"
+
+	if name := s.pending["udid1"].document["name"]; name != "renamed" {
+		t.Errorf("expected the buffered update not to change with the caller fields, got %v", name)
+	}
+}
+
+func TestRethinkStoreBuffersEvents(t *testing.T) {
+	s := newDisconnectedRethinkStore()
+
+	for i := 1; i <= maxPendingEvents+2; i++ {
+		s.InsertEvent(DeviceEvent{UDID: "udid1", Type: EventConnected, Timestamp: int64(i)})
+	}
+
+	if len(s.pendingEvents) != maxPendingEvents {
+		t.Fatalf("expected %d pending events, got %d", maxPendingEvents, len(s.pendingEvents))
+	}
+	if s.pendingEvents[0].Timestamp != 3 {
+		t.Errorf("expected the oldest events to be dropped, the first event has timestamp %d", s.pendingEvents[0].Timestamp)
+	}
+}
+
+func TestRethinkStoreFlushPending(t *testing.T) {
+	s := newDisconnectedRethinkStore()
+	s.Update("udid1", map[string]interface{}{"name": "renamed"})
+	s.Delete("udid2")
+	s.InsertEvent(DeviceEvent{UDID: "udid1", Timestamp: 1})
+	s.InsertEvent(DeviceEvent{UDID: "udid2", Timestamp: 2})
+
+	written := make(map[string]pendingWrite)
+	var events []int64
+	err := s.flushPending(func(udid string, write pendingWrite) error {
+		written[udid] = write
+		return nil
+	}, func(event DeviceEvent) error {
+		events = append(events, event.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(written) != 2 || written["udid1"].op != "update" || written["udid2"].op != "delete" {
+		t.Errorf("expected the buffered writes to be flushed, got %+v", written)
+	}
+	if !reflect.DeepEqual(events, []int64{1, 2}) {
+		t.Errorf("expected the events to be flushed in order, got %v", events)
+	}
+	status := s.Status()
+	if !status.Connected || status.PendingWrites != 0 {
+		t.Errorf("expected the store to be connected without pending writes, got %+v", status)
+	}
+}
+
+func TestRethinkStoreFlushPendingRequeuesOnWriteError(t *testing.T) {
+	s := newDisconnectedRethinkStore()
+	s.Insert(newTestDevice("udid1", true))
+	s.InsertEvent(DeviceEvent{UDID: "udid1", Timestamp: 1})
+
+	writeErr := errors.New("write timed out")
+	err := s.flushPending(func(udid string, write pendingWrite) error {
+		// Writes made during the flush are buffered after the flushed ones
+		s.Update("udid1", map[string]interface{}{"name": "renamed"})
+		s.InsertEvent(DeviceEvent{UDID: "udid1", Timestamp: 2})
+		return writeErr
+	}, func(event DeviceEvent) error {
+		t.Error("expected no events to be written after a failed device write")
+		return nil
+	})
+	if !errors.Is(err, writeErr) {
+		t.Fatalf("expected %v, got %v", writeErr, err)
+	}
+
+	// The store stays disconnected so the connection loop reconnects with backoff
+	if s.Status().Connected {
+		t.Error("expected the store to stay disconnected after a failed flush")
+	}
+	udid1 := s.pending["udid1"]
+	if udid1.op != "insert" || udid1.document["name"] != "renamed" || udid1.document["model"] != "Pixel" {
+		t.Errorf("expected the failed insert with the newer update on top, got %+v", udid1)
+	}
+	var events []int64
+	for _, event := range s.pendingEvents {
+		events = append(events, event.Timestamp)
+	}
+	if !reflect.DeepEqual(events, []int64{1, 2}) {
+		t.Errorf("expected the events to be buffered again in order, got %v", events)
+	}
+}
+
+func TestRethinkStoreFlushPendingRequeuesOnEventError(t *testing.T) {
+	s := newDisconnectedRethinkStore()
+	for i := 1; i <= 3; i++ {
+		s.InsertEvent(DeviceEvent{UDID: "udid1", Timestamp: int64(i)})
+	}
+
+	writeErr := errors.New("write timed out")
+	err := s.flushPending(func(udid string, write pendingWrite) error {
+		return nil
+	}, func(event DeviceEvent) error {
+		if event.Timestamp == 2 {
+			return writeErr
+		}
+		return nil
+	})
+	if !errors.Is(err, writeErr) {
+		t.Fatalf("expected %v, got %v", writeErr, err)
+	}
+
+	var events []int64
+	for _, event := range s.pendingEvents {
+		events = append(events, event.Timestamp)
+	}
+	if !reflect.DeepEqual(events, []int64{2, 3}) {
+		t.Errorf("expected the events from the failed one to be buffered again, got %v", events)
+	}
+}
@@ -0,0 +1,273 @@
+package device
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCloneCopiesContainerOverrides(t *testing.T) {
+	device := newTestDevice("udid1", true)
+	device.ContainerConfig = &ContainerOverrides{
+		Env:    map[string]string{"KEY": "value"},
+		Mounts: []ContainerMount{{Source: "/host", Target: "/container"}},
+	}
+
+	deviceCopy := device.clone()
+	device.ContainerConfig.Env["KEY"] = "changed"
+	device.ContainerConfig.Mounts[0].Source = "/changed"
+
+	if deviceCopy.ContainerConfig == device.ContainerConfig {
+		t.Fatal("expected the copy to have its own container overrides")
+	}
+	if deviceCopy.ContainerConfig.Env["KEY"] != "value" {
+		t.Errorf("expected the copied env to be unchanged, got %s", deviceCopy.ContainerConfig.Env["KEY"])
+	}
+	if deviceCopy.ContainerConfig.Mounts[0].Source != "/host" {
+		t.Errorf("expected the copied mounts to be unchanged, got %s", deviceCopy.ContainerConfig.Mounts[0].Source)
+	}
+}
+
+// Run the DeviceStore contract against the backends that do not need a database server
+func TestMemoryStore(t *testing.T) {
+	testDeviceStore(t, func(t *testing.T) DeviceStore {
+		return newMemoryStore()
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	testDeviceStore(t, func(t *testing.T) DeviceStore {
+		boltStore, err := newBoltStore(filepath.Join(t.TempDir(), "devices.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return boltStore
+	})
+}
+
+func testDeviceStore(t *testing.T, newStore func(t *testing.T) DeviceStore) {
+	t.Run("insert and get", func(t *testing.T) {
+		deviceStore := newStore(t)
+		defer deviceStore.Close()
+
+		device := newTestDevice("udid1", true)
+		err := deviceStore.Insert(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The store keeps its own copy
+		device.Name = "changed"
+
+		stored, err := deviceStore.Get("udid1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.UDID != "udid1" || stored.Name != "test_udid1" || !stored.Connected {
+			t.Errorf("expected the inserted device, got %+v", stored)
+		}
+
+		_, err = deviceStore.Get("unknown")
+		if !errors.Is(err, ErrStoreDeviceNotFound) {
+			t.Errorf("expected %v, got %v", ErrStoreDeviceNotFound, err)
+		}
+	})
+
+	t.Run("insert replaces the device", func(t *testing.T) {
+		deviceStore := newStore(t)
+		defer deviceStore.Close()
+
+		device := newTestDevice("udid1", true)
+		deviceStore.Insert(device)
+		device.Model = "Pixel 7"
+		err := deviceStore.Insert(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := deviceStore.Get("udid1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Model != "Pixel 7" {
+			t.Errorf("expected the replaced model Pixel 7, got %s", stored.Model)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		deviceStore := newStore(t)
+		defer deviceStore.Close()
+
+		deviceStore.Insert(newTestDevice("udid1", true))
+		err := deviceStore.Update("udid1", map[string]interface{}{"connected": false, "name": "renamed"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := deviceStore.Get("udid1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Connected || stored.Name != "renamed" {
+			t.Errorf("expected the updated fields, got connected %v and name %s", stored.Connected, stored.Name)
+		}
+		if stored.Model != "Pixel" {
+			t.Errorf("expected the other fields to be kept, got model %s", stored.Model)
+		}
+
+		// Updating a missing device does not insert it
+		err = deviceStore.Update("unknown", map[string]interface{}{"name": "unknown"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = deviceStore.Get("unknown")
+		if !errors.Is(err, ErrStoreDeviceNotFound) {
+			t.Errorf("expected %v, got %v", ErrStoreDeviceNotFound, err)
+		}
+	})
+
+	t.Run("list and delete", func(t *testing.T) {
+		deviceStore := newStore(t)
+		defer deviceStore.Close()
+
+		for _, udid := range []string{"udid3", "udid1", "udid2"} {
+			deviceStore.Insert(newTestDevice(udid, true))
+		}
+		err := deviceStore.Delete("udid2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = deviceStore.Delete("unknown")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		devices, err := deviceStore.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var udids []string
+		for _, device := range devices {
+			udids = append(udids, device.UDID)
+		}
+		if strings.Join(udids, ",") != "udid1,udid3" {
+			t.Errorf("expected devices udid1,udid3, got %v", udids)
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		deviceStore := newStore(t)
+
+		changes, err := deviceStore.Watch()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deviceStore.Insert(newTestDevice("udid1", true))
+		deviceStore.Update("udid1", map[string]interface{}{"name": "renamed"})
+		deviceStore.Delete("udid1")
+
+		change := <-changes
+		if change.OldValue != nil || change.NewValue == nil || change.NewValue.UDID != "udid1" {
+			t.Errorf("expected an insert change, got %+v", change)
+		}
+		change = <-changes
+		if change.OldValue == nil || change.OldValue.Name != "test_udid1" || change.NewValue == nil || change.NewValue.Name != "renamed" {
+			t.Errorf("expected an update change, got %+v", change)
+		}
+		change = <-changes
+		if change.OldValue == nil || change.NewValue != nil {
+			t.Errorf("expected a delete change, got %+v", change)
+		}
+
+		err = deviceStore.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-changes; ok {
+			t.Error("expected the watch channel to be closed with the store")
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		deviceStore := newStore(t)
+		defer deviceStore.Close()
+
+		events := []DeviceEvent{
+			{UDID: "udid1", Type: EventConnected, Timestamp: 3000},
+			{UDID: "udid1", Type: EventDisconnected, Timestamp: 1000},
+			{UDID: "udid2", Type: EventConnected, Timestamp: 2000},
+			{UDID: "udid1", Type: EventConnected, Timestamp: 4000},
+		}
+		for _, event := range events {
+			err := deviceStore.InsertEvent(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name       string
+			filter     EventFilter
+			timestamps []int64
+		}{
+			{"all events ordered by timestamp", EventFilter{}, []int64{1000, 2000, 3000, 4000}},
+			{"by udid", EventFilter{UDID: "udid1"}, []int64{1000, 3000, 4000}},
+			{"by type", EventFilter{Type: EventConnected}, []int64{2000, 3000, 4000}},
+			{"since is inclusive", EventFilter{Since: 2000}, []int64{2000, 3000, 4000}},
+			{"all fields", EventFilter{UDID: "udid1", Type: EventConnected, Since: 3500}, []int64{4000}},
+			{"no match", EventFilter{UDID: "unknown"}, nil},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				listed, err := deviceStore.ListEvents(test.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var timestamps []int64
+				for _, event := range listed {
+					if event.ID == "" {
+						t.Errorf("expected the event to get an ID, got %+v", event)
+					}
+					timestamps = append(timestamps, event.Timestamp)
+				}
+				if !reflect.DeepEqual(timestamps, test.timestamps) {
+					t.Errorf("expected events with timestamps %v, got %v", test.timestamps, timestamps)
+				}
+			})
+		}
+	})
+
+	t.Run("events are trimmed per device", func(t *testing.T) {
+		deviceStore := newStore(t)
+		defer deviceStore.Close()
+
+		for i := 1; i <= maxEventsPerDevice+5; i++ {
+			err := deviceStore.InsertEvent(DeviceEvent{UDID: "udid1", Type: EventConnected, Timestamp: int64(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		deviceStore.InsertEvent(DeviceEvent{UDID: "udid2", Type: EventConnected, Timestamp: 1})
+
+		listed, err := deviceStore.ListEvents(EventFilter{UDID: "udid1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != maxEventsPerDevice {
+			t.Fatalf("expected %d events, got %d", maxEventsPerDevice, len(listed))
+		}
+		if listed[0].Timestamp != 6 {
+			t.Errorf("expected the oldest events to be dropped, the first event has timestamp %d", listed[0].Timestamp)
+		}
+
+		listed, err = deviceStore.ListEvents(EventFilter{UDID: "udid2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 1 {
+			t.Errorf("expected the events of other devices to be kept, got %d", len(listed))
+		}
+	})
+}
@@ -10,6 +10,14 @@ import (
 // These udev rules create symlinks for the devices in /dev
 // Which we can then use to check device connectivity and attach devices to their respective containers
 func CreateUdevRules() error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	return createUdevRules()
+}
+
+// Should be called with configMu held
+func createUdevRules() error {
 	log.WithFields(log.Fields{
 		"event": "create_udev_rules",
 	}).Info("Creating udev rules")
@@ -0,0 +1,227 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"howett.net/plist"
+)
+
+const (
+	defaultUsbmuxdSocket = "/var/run/usbmuxd"
+	usbmuxdPlistMessage  = 8
+	lockdownPort         = 62078
+)
+
+// Minimal client for the usbmuxd plist protocol used to list iOS devices and query lockdownd
+type usbmuxdClient struct {
+	socket string
+}
+
+type usbmuxdDevice struct {
+	DeviceID   int
+	Properties struct {
+		SerialNumber   string
+		ConnectionType string
+	}
+}
+
+type usbmuxdListResponse struct {
+	DeviceList []usbmuxdDevice
+}
+
+type usbmuxdResult struct {
+	MessageType string
+	Number      int
+}
+
+type lockdownValueResponse struct {
+	Key   string
+	Value interface{}
+	Error string
+}
+
+func newUsbmuxdClient() *usbmuxdClient {
+	socket := Config.EnvConfig.UsbmuxdSocket
+	if socket == "" {
+		socket = defaultUsbmuxdSocket
+	}
+	return &usbmuxdClient{socket: socket}
+}
+
+// Get the USB attached iOS devices known to usbmuxd
+func (client *usbmuxdClient) listDevices() ([]usbmuxdDevice, error) {
+	conn, err := client.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = usbmuxdSend(conn, map[string]interface{}{
+		"MessageType":         "ListDevices",
+		"ClientVersionString": "GADS-devices-provider",
+		"ProgName":            "GADS-devices-provider",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var response usbmuxdListResponse
+	err = usbmuxdReceive(conn, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []usbmuxdDevice
+	for _, device := range response.DeviceList {
+		if device.Properties.ConnectionType == "USB" {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+// Read values from the lockdownd service of a device
+// Only values available without a paired session can be read this way
+func (client *usbmuxdClient) lockdownValues(deviceID int, keys ...string) (map[string]string, error) {
+	conn, err := client.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// usbmuxd expects the port in network byte order
+	port := lockdownPort
+	err = usbmuxdSend(conn, map[string]interface{}{
+		"MessageType":         "Connect",
+		"ClientVersionString": "GADS-devices-provider",
+		"ProgName":            "GADS-devices-provider",
+		"DeviceID":            deviceID,
+		"PortNumber":          int((port&0xff)<<8 | (port>>8)&0xff),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result usbmuxdResult
+	err = usbmuxdReceive(conn, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Number != 0 {
+		return nil, errors.New("usbmuxd could not connect to lockdownd, result: " + strconv.Itoa(result.Number))
+	}
+
+	// After a successful Connect the socket is a tunnel to lockdownd
+	values := make(map[string]string)
+	for _, key := range keys {
+		err = lockdownSend(conn, map[string]interface{}{
+			"Label":   "GADS-devices-provider",
+			"Request": "GetValue",
+			"Key":     key,
+		})
+		if err != nil {
+			return values, err
+		}
+
+		var response lockdownValueResponse
+		err = lockdownReceive(conn, &response)
+		if err != nil {
+			return values, err
+		}
+		if response.Error != "" {
+			continue
+		}
+		if value, ok := response.Value.(string); ok {
+			values[key] = value
+		}
+	}
+
+	return values, nil
+}
+
+func (client *usbmuxdClient) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", client.socket, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn, nil
+}
+
+// Send a plist message with the usbmuxd header
+func usbmuxdSend(conn net.Conn, message interface{}) error {
+	payload, err := plist.Marshal(message, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	header := []uint32{uint32(16 + len(payload)), 1, usbmuxdPlistMessage, 1}
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(payload)
+
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// Read a plist message with the usbmuxd header
+func usbmuxdReceive(conn net.Conn, v interface{}) error {
+	header := make([]uint32, 4)
+	err := binary.Read(conn, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	if header[0] < 16 {
+		return errors.New("invalid usbmuxd message length")
+	}
+
+	payload := make([]byte, header[0]-16)
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = plist.Unmarshal(payload, v)
+	return err
+}
+
+// Send a plist message prefixed with its big endian length to lockdownd
+func lockdownSend(conn net.Conn, message interface{}) error {
+	payload, err := plist.Marshal(message, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(conn, binary.BigEndian, uint32(len(payload)))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(payload)
+	return err
+}
+
+// Read a plist message prefixed with its big endian length from lockdownd
+func lockdownReceive(conn net.Conn, v interface{}) error {
+	var length uint32
+	err := binary.Read(conn, binary.BigEndian, &length)
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = plist.Unmarshal(payload, v)
+	return err
+}
@@ -7,8 +7,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -35,66 +33,48 @@ func getConnectedDevices() ([]string, error) {
 	return connectedDevices, nil
 }
 
-var cli *client.Client
-
-// Create a docker client singleton to be used by the provider
-// This avoids exhausting docker socket connections and also makes code cleaner
-// Might be changed in the future if this becomes a problem
-func initDockerClient() error {
-	var err error
-	cli, err = client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"event": "get_host_containers",
-		}).Error(". Error: " + err.Error())
-		return err
-	}
-
-	return nil
-}
-
 // Get list of all containers on host
-func getHostContainers() ([]types.Container, error) {
-	if cli == nil {
-		err := initDockerClient()
+func getHostContainers() ([]ContainerInfo, error) {
+	// Get the list of containers from all runtimes used by the devices
+	var containers []ContainerInfo
+	for _, runtime := range activeRuntimes() {
+		runtimeContainers, err := runtime.List(context.Background())
 		if err != nil {
-			return []types.Container{}, err
+			log.WithFields(log.Fields{
+				"event": "get_host_containers",
+			}).Error(". Error: " + err.Error())
+			return nil, errors.New("Could not get " + runtime.Name() + " container list: " + err.Error())
 		}
-	}
-
-	// Get the list of containers
-	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
-	if err != nil {
-		log.WithFields(log.Fields{
-			"event": "get_host_containers",
-		}).Error(". Error: " + err.Error())
-		return nil, errors.New("Could not get container list: " + err.Error())
+		containers = append(containers, runtimeContainers...)
 	}
 	return containers, nil
 }
 
-// Check if device has an existing container
-func (device *Device) hasContainer(allContainers []types.Container) (bool, error) {
-	for _, container := range allContainers {
-		// Parse plain container name
-		containerName := strings.Replace(container.Names[0], "/", "", -1)
+// Get a copy of a registered device that is safe to use without configMu, nil if the device is not registered
+func GetDevice(udid string) *Device {
+	configMu.Lock()
+	defer configMu.Unlock()
 
-		if strings.Contains(containerName, device.UDID) {
-			deviceContainer := DeviceContainer{
-				ContainerID:     container.ID,
-				ContainerStatus: container.Status,
-				ImageName:       container.Image,
-				ContainerName:   containerName,
-			}
-			device.Container = &deviceContainer
-			return true, nil
-		}
+	device := getDeviceByUDID(udid)
+	if device == nil {
+		return nil
+	}
+	return device.clone()
+}
+
+// Append the container data to the device struct
+func (device *Device) setContainer(container ContainerInfo) {
+	device.Container = &DeviceContainer{
+		ContainerID:     container.ID,
+		ContainerStatus: container.Status,
+		ImageName:       container.Image,
+		ContainerName:   container.Name,
 	}
-	return false, nil
 }
 
 // Get a device pointer from Config for a device by udid
-func GetDeviceByUDID(udid string) *Device {
+// Should be called with configMu held
+func getDeviceByUDID(udid string) *Device {
 	for _, device := range Config.Devices {
 		if device.UDID == udid {
 			return device
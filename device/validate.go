@@ -0,0 +1,336 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var screenSizeRegex = regexp.MustCompile(`^[1-9]\d*x[1-9]\d*$`)
+
+// A single problem found when validating the configuration
+type ConfigProblem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Returned when the configuration has one or more problems
+type ConfigValidationError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigValidationError) Error() string {
+	var problems []string
+	for _, problem := range e.Problems {
+		problems = append(problems, problem.Path+": "+problem.Message)
+	}
+	return "config has " + strconv.Itoa(len(e.Problems)) + " problem(s): " + strings.Join(problems, "; ")
+}
+
+// Validate the config.json file on disk without applying it
+func ValidateConfigFile() ([]ConfigProblem, error) {
+	bs, err := getConfigJsonBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var configData ConfigJsonData
+	err = json.Unmarshal(bs, &configData)
+	if err != nil {
+		return []ConfigProblem{{Path: "$", Message: "invalid JSON: " + err.Error()}}, nil
+	}
+
+	return validateConfig(configData), nil
+}
+
+// Validate the whole configuration and return all the found problems
+func validateConfig(configData ConfigJsonData) []ConfigProblem {
+	var problems []ConfigProblem
+
+	envConfig := configData.EnvConfig
+	switch envConfig.DeviceStore {
+	case "", "rethinkdb":
+		if envConfig.RethinkDB == "" {
+			problems = append(problems, ConfigProblem{"$.env-config.rethink_db", "is required"})
+		} else if err := validateHostPort(envConfig.RethinkDB); err != nil {
+			problems = append(problems, ConfigProblem{"$.env-config.rethink_db", err.Error()})
+		}
+	case "memory", "bolt":
+	default:
+		problems = append(problems, ConfigProblem{"$.env-config.device_store", "should be `rethinkdb`, `memory` or `bolt`, got `" + envConfig.DeviceStore + "`"})
+	}
+
+	switch envConfig.ContainerRuntime {
+	case "", "docker", "podman", "fake":
+	default:
+		problems = append(problems, ConfigProblem{"$.env-config.container_runtime", "should be `docker`, `podman` or `fake`, got `" + envConfig.ContainerRuntime + "`"})
+	}
+
+	if envConfig.DevicesHost == "" {
+		problems = append(problems, ConfigProblem{"$.env-config.devices_host", "is required"})
+	}
+
+	if envConfig.ADBServer != "" {
+		if err := validateHostPort(envConfig.ADBServer); err != nil {
+			problems = append(problems, ConfigProblem{"$.env-config.adb_server", err.Error()})
+		}
+	}
+
+	if envConfig.MinDBWriteIntervalMs < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.min_db_write_interval_ms", "should not be negative"})
+	}
+	if envConfig.HealthyTimestampIntervalMs < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.healthy_timestamp_interval_ms", "should not be negative"})
+	}
+	if envConfig.MaxContainerFailures < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.max_container_failures", "should not be negative"})
+	}
+	if envConfig.ContainerFailureWindowSec < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.container_failure_window_sec", "should not be negative"})
+	}
+	if envConfig.OrphanGCIntervalSec < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.orphan_gc_interval_sec", "should not be negative"})
+	}
+	if envConfig.OrphanGCGraceSec < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.orphan_gc_grace_sec", "should not be negative"})
+	}
+	if envConfig.ShutdownTimeoutSec < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.shutdown_timeout_sec", "should not be negative"})
+	}
+	if envConfig.UnhealthyThreshold < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.unhealthy_threshold", "should not be negative"})
+	}
+	if envConfig.HealthyThreshold < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.healthy_threshold", "should not be negative"})
+	}
+	if envConfig.FlapThreshold < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.flap_threshold", "should not be negative"})
+	}
+	if envConfig.FlapWindowSec < 0 {
+		problems = append(problems, ConfigProblem{"$.env-config.flap_window_sec", "should not be negative"})
+	}
+
+	problems = append(problems, validateRunMode("$.env-config.run_mode", envConfig.RunMode)...)
+	problems = append(problems, validateNativeProcesses("$.native-config.android", configData.NativeConfig.Android)...)
+	problems = append(problems, validateNativeProcesses("$.native-config.ios", configData.NativeConfig.IOS)...)
+	problems = append(problems, validateContainerOverrides("$.container-config.android", configData.ContainerConfig.Android)...)
+	problems = append(problems, validateContainerOverrides("$.container-config.ios", configData.ContainerConfig.IOS)...)
+	problems = append(problems, validateExecAllowlist("$.exec-config.android", configData.ExecConfig.Android)...)
+	problems = append(problems, validateExecAllowlist("$.exec-config.ios", configData.ExecConfig.IOS)...)
+
+	problems = append(problems, validateBool("$.env-config.connect_selenium_grid", envConfig.ConnectSeleniumGrid)...)
+	problems = append(problems, validateBool("$.env-config.device_discovery", envConfig.DeviceDiscovery)...)
+
+	udidPaths := make(map[string]string)
+	pinnedPortPaths := make(map[string]string)
+	for index, device := range configData.Devices {
+		devicePath := "$.devices-config[" + strconv.Itoa(index) + "]"
+		if device == nil {
+			problems = append(problems, ConfigProblem{devicePath, "should be a device object"})
+			continue
+		}
+
+		problems = append(problems, device.validateFields(devicePath)...)
+
+		if device.UDID != "" {
+			if otherPath, ok := udidPaths[device.UDID]; ok {
+				problems = append(problems, ConfigProblem{devicePath + ".udid", "duplicate udid `" + device.UDID + "`, already used by " + otherPath})
+			} else {
+				udidPaths[device.UDID] = devicePath
+			}
+		}
+
+		for _, portField := range device.portFields() {
+			port := portField.value
+			if port == "" {
+				continue
+			}
+			portPath := devicePath + "." + portField.name
+			if otherPath, ok := pinnedPortPaths[port]; ok {
+				problems = append(problems, ConfigProblem{portPath, "duplicate port `" + port + "`, already used by " + otherPath})
+			} else {
+				pinnedPortPaths[port] = portPath
+			}
+		}
+	}
+
+	return problems
+}
+
+// Validate the fields of a single device, the path is used as prefix for the problems paths
+func (device *Device) validateFields(path string) []ConfigProblem {
+	var problems []ConfigProblem
+
+	if device.UDID == "" {
+		problems = append(problems, ConfigProblem{path + ".udid", "is required"})
+	}
+
+	if device.OS == "" {
+		problems = append(problems, ConfigProblem{path + ".os", "is required"})
+	} else if device.OS != "ios" && device.OS != "android" {
+		problems = append(problems, ConfigProblem{path + ".os", "should be `ios` or `android`, got `" + device.OS + "`"})
+	}
+
+	if device.Name == "" {
+		problems = append(problems, ConfigProblem{path + ".name", "is required"})
+	} else if strings.ContainsAny(device.Name, " /") {
+		problems = append(problems, ConfigProblem{path + ".name", "should not contain spaces or slashes"})
+	}
+
+	if device.OSVersion == "" {
+		problems = append(problems, ConfigProblem{path + ".os_version", "is required"})
+	}
+
+	if device.ScreenSize == "" {
+		problems = append(problems, ConfigProblem{path + ".screen_size", "is required"})
+	} else if !screenSizeRegex.MatchString(device.ScreenSize) {
+		problems = append(problems, ConfigProblem{path + ".screen_size", "should be in the format `{width}x{height}`, e.g. `1080x2240`, got `" + device.ScreenSize + "`"})
+	}
+
+	if device.Model == "" {
+		problems = append(problems, ConfigProblem{path + ".model", "is required"})
+	}
+
+	for _, portField := range device.portFields() {
+		if portField.value == "" {
+			continue
+		}
+		if err := validatePort(portField.value); err != nil {
+			problems = append(problems, ConfigProblem{path + "." + portField.name, err.Error()})
+		} else if !portField.portRange.contains(portField.value) {
+			problems = append(problems, ConfigProblem{path + "." + portField.name, "should be in the range " + portField.portRange.String() + ", got `" + portField.value + "`"})
+		}
+	}
+	if device.WDAPort != "" && device.OS == "android" {
+		problems = append(problems, ConfigProblem{path + ".wda_port", "is only supported for iOS devices"})
+	}
+
+	problems = append(problems, validateRunMode(path+".run_mode", device.RunMode)...)
+	if device.ContainerConfig != nil {
+		problems = append(problems, validateContainerOverrides(path+".container_config", *device.ContainerConfig)...)
+	}
+
+	return problems
+}
+
+type portField struct {
+	name      string
+	value     string
+	portRange portRange
+}
+
+// Get the port fields of the device with their JSON names and the ranges they are allocated from
+func (device *Device) portFields() []portField {
+	return []portField{
+		{"appium_port", device.AppiumPort, appiumPortRange},
+		{"stream_port", device.StreamPort, streamPortRange},
+		{"container_server_port", device.ContainerServerPort, containerServerPortRange},
+		{"wda_port", device.WDAPort, wdaPortRange},
+	}
+}
+
+// Check that an optional string flag is `true` or `false`
+func validateBool(path string, value string) []ConfigProblem {
+	if value != "" && value != "true" && value != "false" {
+		return []ConfigProblem{{path, "should be `true` or `false`, got `" + value + "`"}}
+	}
+	return nil
+}
+
+func validateRunMode(path string, value string) []ConfigProblem {
+	if value != "" && value != "container" && value != "native" {
+		return []ConfigProblem{{path, "should be `container` or `native`, got `" + value + "`"}}
+	}
+	return nil
+}
+
+// Validate the processes started for a device in native mode
+func validateNativeProcesses(path string, processes []NativeProcess) []ConfigProblem {
+	var problems []ConfigProblem
+	names := make(map[string]bool)
+	for index, process := range processes {
+		processPath := path + "[" + strconv.Itoa(index) + "]"
+		if process.Name == "" {
+			problems = append(problems, ConfigProblem{processPath + ".name", "is required"})
+		} else if strings.ContainsAny(process.Name, " /") {
+			problems = append(problems, ConfigProblem{processPath + ".name", "should not contain spaces or slashes"})
+		} else if names[process.Name] {
+			problems = append(problems, ConfigProblem{processPath + ".name", "duplicate process name `" + process.Name + "`"})
+		}
+		names[process.Name] = true
+
+		if process.Command == "" {
+			problems = append(problems, ConfigProblem{processPath + ".command", "is required"})
+		}
+	}
+	return problems
+}
+
+// Validate the container overrides of an OS or a device
+func validateContainerOverrides(path string, overrides ContainerOverrides) []ConfigProblem {
+	var problems []ConfigProblem
+	var names []string
+	for name := range overrides.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" || strings.Contains(name, "=") {
+			problems = append(problems, ConfigProblem{path + ".env", "invalid variable name `" + name + "`"})
+		}
+	}
+
+	for index, containerMount := range overrides.Mounts {
+		mountPath := path + ".mounts[" + strconv.Itoa(index) + "]"
+		if !filepath.IsAbs(containerMount.Source) {
+			problems = append(problems, ConfigProblem{mountPath + ".source", "should be an absolute path, got `" + containerMount.Source + "`"})
+		}
+		if !filepath.IsAbs(containerMount.Target) {
+			problems = append(problems, ConfigProblem{mountPath + ".target", "should be an absolute path, got `" + containerMount.Target + "`"})
+		}
+	}
+
+	if overrides.CPUs < 0 {
+		problems = append(problems, ConfigProblem{path + ".cpus", "should not be negative"})
+	}
+	if overrides.MemoryMB < 0 {
+		problems = append(problems, ConfigProblem{path + ".memory_mb", "should not be negative"})
+	}
+	return problems
+}
+
+func validateExecAllowlist(path string, allowlist []string) []ConfigProblem {
+	var problems []ConfigProblem
+	for index, entry := range allowlist {
+		if strings.TrimSpace(entry) == "" {
+			problems = append(problems, ConfigProblem{path + "[" + strconv.Itoa(index) + "]", "should not be empty"})
+		}
+	}
+	return problems
+}
+
+// Check that the value is a valid host:port address
+func validateHostPort(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return fmt.Errorf("should be in the format `host:port`, got `%s`", value)
+	}
+	if host == "" {
+		return fmt.Errorf("host is missing in `%s`", value)
+	}
+	return validatePort(port)
+}
+
+// Check that the value is a valid TCP port
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("should be a port between 1 and 65535, got `%s`", value)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+)
+
+func validTestConfig() ConfigJsonData {
+	return ConfigJsonData{
+		EnvConfig: EnvConfig{
+			DevicesHost: "192.168.1.2",
+			RethinkDB:   "192.168.1.2:32771",
+		},
+		Devices: []*Device{
+			{UDID: "udid1", OS: "android", Name: "Pixel_7", OSVersion: "13", ScreenSize: "1080x2400", Model: "Pixel 7"},
+			{UDID: "udid2", OS: "ios", Name: "iPhone_SE", OSVersion: "16.5", ScreenSize: "375x667", Model: "iPhone SE"},
+		},
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(config *ConfigJsonData)
+		expected []ConfigProblem
+	}{
+		{
+			name:     "valid config",
+			modify:   func(config *ConfigJsonData) {},
+			expected: nil,
+		},
+		{
+			name: "duplicate udid",
+			modify: func(config *ConfigJsonData) {
+				config.Devices[1].UDID = "udid1"
+			},
+			expected: []ConfigProblem{
+				{"$.devices-config[1].udid", "duplicate udid `udid1`, already used by $.devices-config[0]"},
+			},
+		},
+		{
+			name: "bad os",
+			modify: func(config *ConfigJsonData) {
+				config.Devices[0].OS = "windows"
+			},
+			expected: []ConfigProblem{
+				{"$.devices-config[0].os", "should be `ios` or `android`, got `windows`"},
+			},
+		},
+		{
+			name: "missing fields",
+			modify: func(config *ConfigJsonData) {
+				config.Devices[1] = &Device{}
+			},
+			expected: []ConfigProblem{
+				{"$.devices-config[1].udid", "is required"},
+				{"$.devices-config[1].os", "is required"},
+				{"$.devices-config[1].name", "is required"},
+				{"$.devices-config[1].os_version", "is required"},
+				{"$.devices-config[1].screen_size", "is required"},
+				{"$.devices-config[1].model", "is required"},
+			},
+		},
+		{
+			name: "null device",
+			modify: func(config *ConfigJsonData) {
+				config.Devices[0] = nil
+			},
+			expected: []ConfigProblem{
+				{"$.devices-config[0]", "should be a device object"},
+			},
+		},
+		{
+			name: "bad screen size",
+			modify: func(config *ConfigJsonData) {
+				config.Devices[0].ScreenSize = "1080*2240"
+			},
+			expected: []ConfigProblem{
+				{"$.devices-config[0].screen_size", "should be in the format `{width}x{height}`, e.g. `1080x2240`, got `1080*2240`"},
+			},
+		},
+		{
+			name: "bad ports",
+			modify: func(config *ConfigJsonData) {
+				config.Devices[0].AppiumPort = "abc"
+				config.Devices[0].StreamPort = "70000"
+				config.Devices[0].ContainerServerPort = "4850"
+				config.Devices[0].WDAPort = "20001"
+			},
+			expected: []ConfigProblem{
+				{"$.devices-config[0].appium_port", "should be a port between 1 and 65535, got `abc`"},
+				{"$.devices-config[0].stream_port", "should be a port between 1 and 65535, got `70000`"},
+				{"$.devices-config[0].container_server_port", "should be in the range 20201-20300, got `4850`"},
+				{"$.devices-config[0].wda_port", "is only supported for iOS devices"},
+			},
+		},
+		{
+			name: "duplicate ports",
+			modify: func(config *ConfigJsonData) {
+				config.Devices[0].AppiumPort = "4850"
+				config.Devices[1].AppiumPort = "4850"
+			},
+			expected: []ConfigProblem{
+				{"$.devices-config[1].appium_port", "duplicate port `4850`, already used by $.devices-config[0].appium_port"},
+			},
+		},
+		{
+			name: "invalid run mode",
+			modify: func(config *ConfigJsonData) {
+				config.EnvConfig.RunMode = "vm"
+				config.Devices[1].RunMode = "host"
+			},
+			expected: []ConfigProblem{
+				{"$.env-config.run_mode", "should be `container` or `native`, got `vm`"},
+				{"$.devices-config[1].run_mode", "should be `container` or `native`, got `host`"},
+			},
+		},
+		{
+			name: "invalid container config",
+			modify: func(config *ConfigJsonData) {
+				config.ContainerConfig.Android = ContainerOverrides{
+					Env:    map[string]string{"B=C": "1", "VALID": "1"},
+					Mounts: []ContainerMount{{Source: "relative", Target: "/opt/apps"}},
+				}
+				config.Devices[0].ContainerConfig = &ContainerOverrides{
+					Mounts:   []ContainerMount{{Source: "/opt/apps", Target: "apps"}},
+					CPUs:     -1,
+					MemoryMB: -512,
+				}
+			},
+			expected: []ConfigProblem{
+				{"$.container-config.android.env", "invalid variable name `B=C`"},
+				{"$.container-config.android.mounts[0].source", "should be an absolute path, got `relative`"},
+				{"$.devices-config[0].container_config.mounts[0].target", "should be an absolute path, got `apps`"},
+				{"$.devices-config[0].container_config.cpus", "should not be negative"},
+				{"$.devices-config[0].container_config.memory_mb", "should not be negative"},
+			},
+		},
+		{
+			name: "invalid env config",
+			modify: func(config *ConfigJsonData) {
+				config.EnvConfig.DevicesHost = ""
+				config.EnvConfig.RethinkDB = "localhost"
+				config.EnvConfig.DeviceDiscovery = "yes"
+			},
+			expected: []ConfigProblem{
+				{"$.env-config.rethink_db", "should be in the format `host:port`, got `localhost`"},
+				{"$.env-config.devices_host", "is required"},
+				{"$.env-config.device_discovery", "should be `true` or `false`, got `yes`"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validTestConfig()
+			test.modify(&config)
+
+			problems := validateConfig(config)
+			if !reflect.DeepEqual(problems, test.expected) {
+				t.Errorf("expected problems %v, got %v", test.expected, problems)
+			}
+		})
+	}
+}
+
+func TestConfigValidationErrorMessage(t *testing.T) {
+	err := &ConfigValidationError{Problems: []ConfigProblem{
+		{"$.devices-config[0].os", "is required"},
+		{"$.env-config.devices_host", "is required"},
+	}}
+
+	expected := "config has 2 problem(s): $.devices-config[0].os: is required; $.env-config.devices_host: is required"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
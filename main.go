@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/shamanec/GADS-devices-provider/device"
 	_ "github.com/shamanec/GADS-devices-provider/docs"
@@ -34,7 +38,16 @@ func main() {
 	// Parse config.json, get the connected devices and updated the DB with the initial data
 	err := device.SetupConfig()
 	if err != nil {
+		// Refuse to start with an invalid config.json and list all the problems
+		if validationErr, ok := err.(*device.ConfigValidationError); ok {
+			fmt.Println("Invalid config.json, fix the following problems and start the provider again:")
+			for _, problem := range validationErr.Problems {
+				fmt.Println("  " + problem.Path + ": " + problem.Message)
+			}
+			os.Exit(1)
+		}
 		fmt.Println("Initial config setup failed: " + err.Error())
+		os.Exit(1)
 	}
 
 	// Start a goroutine that will update devices on provider start and when there are events in /dev(device connected/disconnected)
@@ -42,5 +55,40 @@ func main() {
 
 	// Handle the endpoints
 	r := router.HandleRequests()
-	r.Run(":10001")
+	server := &http.Server{Addr: ":10001", Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("Could not start the provider server: " + err.Error())
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	fmt.Println("Shutting down provider")
+	log.WithFields(log.Fields{
+		"event": "provider_shutdown",
+	}).Info("Shutting down provider")
+
+	// Stop accepting requests and wait for the in-flight ones, including the proxied Appium calls
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), device.ShutdownTimeout())
+	defer cancelDrain()
+	err = server.Shutdown(drainCtx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "provider_shutdown",
+		}).Warn("Could not drain all requests in time: " + err.Error())
+		server.Close()
+	}
+
+	// Mark the devices offline and stop their containers if configured
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), device.ShutdownTimeout())
+	defer cancelShutdown()
+	device.Shutdown(shutdownCtx)
+	fmt.Println("Provider stopped")
 }
@@ -11,27 +11,28 @@ import (
 	"github.com/shamanec/GADS-devices-provider/device"
 )
 
-// Check the device health by checking Appium and WDA(for iOS)
+// Check the device health and respond with the result of each component
+// Responds with 500 if any of the components is not healthy
 func DeviceHealth(c *gin.Context) {
 	udid := c.Param("udid")
-	bool, err := device.GetDeviceHealth(udid)
+	report, err := device.GetDeviceHealth(udid)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		JSONError(c.Writer, "device_health", "Could not check the health of device with udid: "+udid+": "+err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if bool {
-		c.Writer.WriteHeader(200)
+	if report.Healthy {
+		c.JSON(200, report)
 		return
 	}
 
-	c.Writer.WriteHeader(500)
+	c.JSON(500, report)
 }
 
 // Call the respective Appium/WDA endpoint to go to Homescreen
 func DeviceHome(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	// Send the request
 	homeResponse, err := appiumHome(device)
@@ -56,7 +57,7 @@ func DeviceHome(c *gin.Context) {
 // Call respective Appium/WDA endpoint to lock the device
 func DeviceLock(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	lockResponse, err := appiumLockUnlock(device, "lock")
 	if err != nil {
@@ -80,7 +81,7 @@ func DeviceLock(c *gin.Context) {
 // Call the respective Appium/WDA endpoint to unlock the device
 func DeviceUnlock(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	lockResponse, err := appiumLockUnlock(device, "unlock")
 	if err != nil {
@@ -104,7 +105,7 @@ func DeviceUnlock(c *gin.Context) {
 // Call the respective Appium/WDA endpoint to take a screenshot of the device screen
 func DeviceScreenshot(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	screenshotResp, err := appiumScreenshot(device)
 	defer screenshotResp.Body.Close()
@@ -127,16 +128,9 @@ func DeviceScreenshot(c *gin.Context) {
 // Call the device stream endpoint and proxy it to the respective provider stream endpoint
 func DeviceStream(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
-
-	deviceStreamURL := ""
-	if device.OS == "android" {
-		deviceStreamURL = "http://localhost:" + device.ContainerServerPort + "/stream"
-	}
+	device := device.GetDevice(udid)
 
-	if device.OS == "ios" {
-		deviceStreamURL = "http://localhost:" + device.StreamPort
-	}
+	deviceStreamURL := device.StreamURL()
 	client := http.Client{}
 
 	// Replace this URL with the actual endpoint URL serving the JPEG stream
@@ -168,7 +162,7 @@ func copyHeaders(destination, source http.Header) {
 
 func DeviceAppiumSource(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	sourceResp, err := appiumSource(device)
 	if err != nil {
@@ -196,7 +190,7 @@ type actionData struct {
 	X          float64 `json:"x,omitempty"`
 	Y          float64 `json:"y,omitempty"`
 	EndX       float64 `json:"endX,omitempty"`
-	EndY       float64 `json:"endY,omitempty`
+	EndY       float64 `json:"endY,omitempty"`
 	TextToType string  `json:"text,omitempty"`
 }
 
@@ -226,7 +220,7 @@ type devicePointerActions struct {
 
 func DeviceTypeText(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	var requestBody actionData
 	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
@@ -254,7 +248,7 @@ func DeviceTypeText(c *gin.Context) {
 
 func DeviceClearText(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	clearResp, err := appiumClearText(device)
 	if err != nil {
@@ -276,7 +270,7 @@ func DeviceClearText(c *gin.Context) {
 
 func DeviceTap(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	var requestBody actionData
 	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
@@ -305,7 +299,7 @@ func DeviceTap(c *gin.Context) {
 
 func DeviceSwipe(c *gin.Context) {
 	udid := c.Param("udid")
-	device := device.GetDeviceByUDID(udid)
+	device := device.GetDevice(udid)
 
 	var requestBody actionData
 	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
@@ -0,0 +1,171 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/device"
+)
+
+const testConfig = `{
+  "env-config": {
+    "devices_host": "test-host",
+    "device_store": "memory",
+    "container_runtime": "fake"
+  },
+  "devices-config": [
+    {
+      "os": "android",
+      "name": "Pixel_7",
+      "os_version": "13",
+      "udid": "udid1",
+      "screen_size": "1080x2400",
+      "model": "Pixel 7"
+    }
+  ]
+}`
+
+var testRouter *gin.Engine
+
+// Set up the provider once with the in-memory store and the fake container runtime in a temp dir
+func TestMain(m *testing.M) {
+	tempDir, err := os.MkdirTemp("", "router-test")
+	if err != nil {
+		panic(err)
+	}
+	code := runRouterTests(m, tempDir)
+	os.RemoveAll(tempDir)
+	os.Exit(code)
+}
+
+func runRouterTests(m *testing.M, tempDir string) int {
+	err := os.Mkdir(filepath.Join(tempDir, "configs"), 0755)
+	if err != nil {
+		panic(err)
+	}
+	err = os.WriteFile(filepath.Join(tempDir, "configs", "config.json"), []byte(testConfig), 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chdir(tempDir)
+	if err != nil {
+		panic(err)
+	}
+	err = device.SetupConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	testRouter = HandleRequests()
+	return m.Run()
+}
+
+// Sorted keys of a decoded JSON object
+func jsonKeys(object map[string]interface{}) []string {
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeviceHealth(t *testing.T) {
+	// Fake Appium server with an existing session, also used as the container server
+	appium := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			w.Write([]byte(`{"value": {"ready": true}}`))
+		case "/sessions":
+			w.Write([]byte(`{"value": [{"id": "session1"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer appium.Close()
+	appiumURL, err := url.Parse(appium.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDevice := device.Config.Devices[0]
+	testDevice.AppiumPort = appiumURL.Port()
+	testDevice.ContainerServerPort = appiumURL.Port()
+
+	recorder := httptest.NewRecorder()
+	testRouter.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/device/udid1/health", nil))
+
+	// The device has no container so it is not healthy
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, recorder.Code)
+	}
+
+	var report map[string]interface{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := jsonKeys(report); !reflect.DeepEqual(keys, []string{"components", "healthy", "timestamp"}) {
+		t.Errorf("expected the report fields components, healthy and timestamp, got %v", keys)
+	}
+	if report["healthy"] != false {
+		t.Errorf("expected the report to be unhealthy, got %v", report["healthy"])
+	}
+
+	expected := []struct {
+		name    string
+		healthy bool
+		error   string
+	}{
+		{"container", false, "the device has no container"},
+		{"appium", true, ""},
+		{"stream", true, ""},
+		{"container_server", true, ""},
+		{"session", true, ""},
+	}
+	components, ok := report["components"].([]interface{})
+	if !ok || len(components) != len(expected) {
+		t.Fatalf("expected %d components, got %v", len(expected), report["components"])
+	}
+	for i, expectedComponent := range expected {
+		component := components[i].(map[string]interface{})
+		expectedKeys := []string{"healthy", "latency_ms", "name"}
+		if expectedComponent.error != "" {
+			expectedKeys = []string{"error", "healthy", "latency_ms", "name"}
+		}
+		if keys := jsonKeys(component); !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("expected the component fields %v, got %v", expectedKeys, keys)
+		}
+		if component["name"] != expectedComponent.name || component["healthy"] != expectedComponent.healthy {
+			t.Errorf("expected component %s with healthy %v, got %v", expectedComponent.name, expectedComponent.healthy, component)
+		}
+		if expectedComponent.error != "" && component["error"] != expectedComponent.error {
+			t.Errorf("expected the %s error %q, got %v", expectedComponent.name, expectedComponent.error, component["error"])
+		}
+	}
+}
+
+func TestDeviceHealthUnknownDevice(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	testRouter.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/device/unknown/health", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+	var response JsonErrorResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.EventName != "device_health" {
+		t.Errorf("expected the device_health event, got %s", response.EventName)
+	}
+}
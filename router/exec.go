@@ -0,0 +1,142 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/device"
+)
+
+const (
+	defaultExecTimeout = 30 * time.Second
+	// Commands that outlive the timeout cannot always be stopped, so long timeouts are not allowed
+	maxExecTimeoutSec = 300
+)
+
+type execRequest struct {
+	// The command and its arguments, e.g. ["adb", "shell", "getprop"]
+	Command    []string `json:"command"`
+	TimeoutSec int      `json:"timeout_sec,omitempty"`
+}
+
+type execResponse struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+// Last line of a streamed exec response
+type execResult struct {
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Run an allowed command inside the container of a device
+// With `stream=true` the output is streamed as JSON lines followed by a line with the exit code
+func DeviceExec(c *gin.Context) {
+	udid := c.Param("udid")
+
+	var request execRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil {
+		JSONError(c.Writer, "device_exec", "Could not decode request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Command) == 0 {
+		JSONError(c.Writer, "device_exec", "`command` is required", http.StatusBadRequest)
+		return
+	}
+	if request.TimeoutSec < 0 {
+		JSONError(c.Writer, "device_exec", "`timeout_sec` should not be negative", http.StatusBadRequest)
+		return
+	}
+	if request.TimeoutSec > maxExecTimeoutSec {
+		JSONError(c.Writer, "device_exec", "`timeout_sec` should not be more than "+strconv.Itoa(maxExecTimeoutSec), http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultExecTimeout
+	if request.TimeoutSec > 0 {
+		timeout = time.Duration(request.TimeoutSec) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	if c.Query("stream") == "true" {
+		streamDeviceExec(ctx, c, udid, request.Command)
+		return
+	}
+
+	var stdout, stderr strings.Builder
+	exitCode, err := device.ExecInDevice(ctx, udid, request.Command, func(line device.LogLine) error {
+		if line.Stream == "stderr" {
+			stderr.WriteString(line.Line + "\n")
+		} else {
+			stdout.WriteString(line.Line + "\n")
+		}
+		return nil
+	})
+	if err != nil {
+		JSONError(c.Writer, "device_exec", "Could not run command in device with udid: "+udid+": "+err.Error(), execErrorCode(err))
+		return
+	}
+
+	c.JSON(200, execResponse{
+		ExitCode: exitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	})
+}
+
+func streamDeviceExec(ctx context.Context, c *gin.Context, udid string, cmd []string) {
+	encoder := json.NewEncoder(c.Writer)
+	started := false
+	exitCode, err := device.ExecInDevice(ctx, udid, cmd, func(line device.LogLine) error {
+		if !started {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(200)
+			started = true
+		}
+		err := encoder.Encode(line)
+		if err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+
+	// Errors before any output are returned with a proper status code
+	if err != nil && !started {
+		JSONError(c.Writer, "device_exec", "Could not run command in device with udid: "+udid+": "+err.Error(), execErrorCode(err))
+		return
+	}
+	if !started {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(200)
+	}
+
+	result := execResult{ExitCode: exitCode}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	encoder.Encode(result)
+}
+
+// Map device exec errors to response codes
+func execErrorCode(err error) int {
+	switch {
+	case errors.Is(err, device.ErrCommandNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, device.ErrDeviceNotFound), errors.Is(err, device.ErrNoContainer):
+		return http.StatusNotFound
+	case errors.Is(err, device.ErrExecNotStopped), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,65 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shamanec/GADS-devices-provider/device"
+)
+
+func TestExecErrorCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"not allowed", device.ErrCommandNotAllowed, http.StatusForbidden},
+		{"unknown device", device.ErrDeviceNotFound, http.StatusNotFound},
+		{"no container", device.ErrNoContainer, http.StatusNotFound},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"wrapped timeout", fmt.Errorf("exec failed: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"not stopped", fmt.Errorf("%w: %s", device.ErrExecNotStopped, context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"other error", errors.New("container is not running"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := execErrorCode(test.err); code != test.expected {
+				t.Errorf("expected status %d, got %d", test.expected, code)
+			}
+		})
+	}
+}
+
+func TestDeviceExecRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		udid     string
+		body     string
+		expected int
+	}{
+		{"invalid body", "udid1", `{"command": "adb"}`, http.StatusBadRequest},
+		{"missing command", "udid1", `{}`, http.StatusBadRequest},
+		{"negative timeout", "udid1", `{"command": ["adb"], "timeout_sec": -1}`, http.StatusBadRequest},
+		{"timeout over the maximum", "udid1", `{"command": ["adb"], "timeout_sec": 301}`, http.StatusBadRequest},
+		{"unknown device", "unknown", `{"command": ["adb"]}`, http.StatusNotFound},
+		{"device without container", "udid1", `{"command": ["adb"]}`, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/device/"+test.udid+"/exec", strings.NewReader(test.body))
+			testRouter.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.expected {
+				t.Errorf("expected status %d, got %d: %s", test.expected, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
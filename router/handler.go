@@ -11,7 +11,22 @@ func HandleRequests() *gin.Engine {
 	router.Use(cors.Default())
 	router.GET("/device/:udid/health", DeviceHealth)
 	router.GET("/device/list", GetProviderDevices)
+	router.POST("/device/:udid", RegisterDevice)
+	router.PUT("/device/:udid", UpdateDevice)
+	router.DELETE("/device/:udid", UnregisterDevice)
+	router.POST("/device/:udid/adopt", AdoptDevice)
+	router.GET("/device/:udid/events", GetDeviceEvents)
+	router.DELETE("/device/:udid/quarantine", ClearDeviceQuarantine)
+	router.GET("/device/:udid/logs", GetDeviceLogs)
+	router.POST("/device/:udid/exec", DeviceExec)
+	router.GET("/device/:udid/stats", GetDeviceStats)
+	router.GET("/containers/stats", GetContainersStats)
 	router.GET("/containers/:containerID/logs", GetContainerLogs)
+	router.POST("/containers/gc", CollectOrphanContainers)
+	router.GET("/rollouts", GetImageRollouts)
+	router.GET("/rollouts/:os", GetImageRollout)
+	router.POST("/rollouts/:os", StartImageRollout)
+	router.POST("/rollouts/:os/rollback", RollbackImageRollout)
 	router.POST("/device/create-udev-rules", CreateUdevRules)
 	router.POST("/device/:udid/tap", DeviceTap)
 	router.POST("/device/:udid/home", DeviceHome)
@@ -24,6 +39,9 @@ func HandleRequests() *gin.Engine {
 	router.POST("/device/:udid/typeText", DeviceTypeText)
 	router.POST("/device/:udid/clearText", DeviceClearText)
 	router.GET("/logs", GetLogs)
+	router.POST("/config/reload", ReloadConfig)
+	router.GET("/config/validate", ValidateConfig)
+	router.GET("/provider/status", GetProviderStatus)
 
 	return router
 }
@@ -0,0 +1,108 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/device"
+	log "github.com/sirupsen/logrus"
+)
+
+// Stream the logs of a container as JSON lines with the stream each line was written to
+// Optional query params: `tail` number of lines or `all`, `since` unix timestamp, RFC3339 time or duration like `10m`,
+// `stdout` and `stderr` to select the streams (both by default) and `follow` to keep streaming new lines
+func GetContainerLogs(c *gin.Context) {
+	streamContainerLogs(c, c.Param("containerID"))
+}
+
+// Stream the logs of the current container of a device, same query params as GetContainerLogs
+func GetDeviceLogs(c *gin.Context) {
+	udid := c.Param("udid")
+
+	containerID, err := device.GetDeviceContainerID(udid)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, device.ErrDeviceNotFound) || errors.Is(err, device.ErrNoContainer) {
+			code = http.StatusNotFound
+		}
+		JSONError(c.Writer, "get_container_logs", "Could not get logs for device with udid: "+udid+": "+err.Error(), code)
+		return
+	}
+
+	streamContainerLogs(c, containerID)
+}
+
+func streamContainerLogs(c *gin.Context, containerID string) {
+	options, err := logOptions(c)
+	if err != nil {
+		JSONError(c.Writer, "get_container_logs", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The logs stop following when the client disconnects
+	out, err := device.GetContainerLogs(c.Request.Context(), containerID, options)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "get_container_logs",
+		}).Error("Could not get logs for container with ID: " + containerID + ". Error: " + err.Error())
+		JSONError(c.Writer, "get_container_logs", "Could not get logs for container with ID: "+containerID+": "+err.Error(), 500)
+		return
+	}
+	defer out.Close()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(200)
+	encoder := json.NewEncoder(c.Writer)
+	err = device.ReadLogLines(out, func(line device.LogLine) error {
+		err := encoder.Encode(line)
+		if err != nil {
+			return err
+		}
+		if options.Follow {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil && c.Request.Context().Err() == nil {
+		log.WithFields(log.Fields{
+			"event": "get_container_logs",
+		}).Error("Could not stream logs for container with ID: " + containerID + ". Error: " + err.Error())
+	}
+}
+
+// Get the log options from the query params
+func logOptions(c *gin.Context) (device.LogOptions, error) {
+	options := device.LogOptions{
+		Stdout: c.DefaultQuery("stdout", "true") == "true",
+		Stderr: c.DefaultQuery("stderr", "true") == "true",
+		Tail:   c.DefaultQuery("tail", "all"),
+		Since:  c.Query("since"),
+		Follow: c.Query("follow") == "true",
+	}
+
+	if !options.Stdout && !options.Stderr {
+		return options, errors.New("at least one of `stdout` and `stderr` should be true")
+	}
+
+	if options.Tail != "all" {
+		tail, err := strconv.Atoi(options.Tail)
+		if err != nil || tail < 0 {
+			return options, errors.New("`tail` should be a non-negative number of lines or `all`")
+		}
+	}
+
+	if options.Since != "" {
+		_, floatErr := strconv.ParseFloat(options.Since, 64)
+		_, timeErr := time.Parse(time.RFC3339, options.Since)
+		_, durationErr := time.ParseDuration(options.Since)
+		if floatErr != nil && timeErr != nil && durationErr != nil {
+			return options, errors.New("`since` should be a unix timestamp, RFC3339 time or duration like `10m`")
+		}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/device"
+)
+
+func TestLogOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected device.LogOptions
+		err      string
+	}{
+		{
+			name:     "defaults",
+			query:    "",
+			expected: device.LogOptions{Stdout: true, Stderr: true, Tail: "all"},
+		},
+		{
+			name:     "tail number of lines",
+			query:    "tail=100",
+			expected: device.LogOptions{Stdout: true, Stderr: true, Tail: "100"},
+		},
+		{
+			name:     "tail zero",
+			query:    "tail=0",
+			expected: device.LogOptions{Stdout: true, Stderr: true, Tail: "0"},
+		},
+		{
+			name:  "negative tail",
+			query: "tail=-1",
+			err:   "`tail` should be a non-negative number of lines or `all`",
+		},
+		{
+			name:  "invalid tail",
+			query: "tail=last",
+			err:   "`tail` should be a non-negative number of lines or `all`",
+		},
+		{
+			name:     "since unix timestamp",
+			query:    "since=1700000000.5",
+			expected: device.LogOptions{Stdout: true, Stderr: true, Tail: "all", Since: "1700000000.5"},
+		},
+		{
+			name:     "since RFC3339 time",
+			query:    "since=2023-11-14T22:13:20Z",
+			expected: device.LogOptions{Stdout: true, Stderr: true, Tail: "all", Since: "2023-11-14T22:13:20Z"},
+		},
+		{
+			name:     "since duration",
+			query:    "since=10m",
+			expected: device.LogOptions{Stdout: true, Stderr: true, Tail: "all", Since: "10m"},
+		},
+		{
+			name:  "invalid since",
+			query: "since=yesterday",
+			err:   "`since` should be a unix timestamp, RFC3339 time or duration like `10m`",
+		},
+		{
+			name:     "stderr only and follow",
+			query:    "stdout=false&follow=true",
+			expected: device.LogOptions{Stderr: true, Tail: "all", Follow: true},
+		},
+		{
+			name:  "no streams",
+			query: "stdout=false&stderr=false",
+			err:   "at least one of `stdout` and `stderr` should be true",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/device/udid1/logs?"+test.query, nil)
+
+			options, err := logOptions(c)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options != test.expected {
+				t.Errorf("expected options %+v, got %+v", test.expected, options)
+			}
+		})
+	}
+}
+
+func TestGetDeviceLogsNotFound(t *testing.T) {
+	for _, udid := range []string{"unknown", "udid1"} {
+		recorder := httptest.NewRecorder()
+		testRouter.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/device/"+udid+"/logs", nil))
+
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("expected status %d for device %s, got %d", http.StatusNotFound, udid, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/device"
+)
+
+// Register a new device at runtime and persist it to config.json
+func RegisterDevice(c *gin.Context) {
+	newDevice, ok := decodeDeviceRequest(c, "register_device")
+	if !ok {
+		return
+	}
+
+	err := device.RegisterDevice(newDevice)
+	if err != nil {
+		JSONError(c.Writer, "register_device", err.Error(), registrationErrorCode(err))
+		return
+	}
+
+	SimpleJSONResponse(c.Writer, "Successfully registered device with udid: "+newDevice.UDID, 200)
+}
+
+// Update a registered device at runtime and persist the change to config.json
+func UpdateDevice(c *gin.Context) {
+	newDevice, ok := decodeDeviceRequest(c, "update_device")
+	if !ok {
+		return
+	}
+
+	err := device.UpdateRegisteredDevice(newDevice)
+	if err != nil {
+		JSONError(c.Writer, "update_device", err.Error(), registrationErrorCode(err))
+		return
+	}
+
+	SimpleJSONResponse(c.Writer, "Successfully updated device with udid: "+newDevice.UDID, 200)
+}
+
+// Unregister a device at runtime and remove it from config.json
+func UnregisterDevice(c *gin.Context) {
+	udid := c.Param("udid")
+
+	err := device.UnregisterDevice(udid)
+	if err != nil {
+		JSONError(c.Writer, "unregister_device", err.Error(), registrationErrorCode(err))
+		return
+	}
+
+	SimpleJSONResponse(c.Writer, "Successfully unregistered device with udid: "+udid, 200)
+}
+
+// Decode the device from the request body and make sure its UDID matches the path UDID
+func decodeDeviceRequest(c *gin.Context, event string) (*device.Device, bool) {
+	udid := c.Param("udid")
+
+	var newDevice device.Device
+	if err := json.NewDecoder(c.Request.Body).Decode(&newDevice); err != nil {
+		JSONError(c.Writer, event, "Could not decode request body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if newDevice.UDID != "" && newDevice.UDID != udid {
+		JSONError(c.Writer, event, "Request body udid does not match the path udid", http.StatusBadRequest)
+		return nil, false
+	}
+	newDevice.UDID = udid
+
+	return &newDevice, true
+}
+
+// Map device registration errors to response codes
+func registrationErrorCode(err error) int {
+	switch {
+	case errors.Is(err, device.ErrInvalidDevice):
+		return http.StatusBadRequest
+	case errors.Is(err, device.ErrDeviceExists), errors.Is(err, device.ErrDeviceNotQuarantined):
+		return http.StatusConflict
+	case errors.Is(err, device.ErrDeviceNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Register a discovered device with the discovered data
+// The optional request body can provide values that could not be discovered or should be overridden
+func AdoptDevice(c *gin.Context) {
+	udid := c.Param("udid")
+
+	var overrides device.Device
+	if c.Request.ContentLength != 0 {
+		if err := json.NewDecoder(c.Request.Body).Decode(&overrides); err != nil {
+			JSONError(c.Writer, "adopt_device", "Could not decode request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := device.AdoptDevice(udid, &overrides)
+	if err != nil {
+		JSONError(c.Writer, "adopt_device", err.Error(), registrationErrorCode(err))
+		return
+	}
+
+	SimpleJSONResponse(c.Writer, "Successfully adopted device with udid: "+udid, 200)
+}
+
+// Clear the quarantine of a crash-looping device so its container is created again
+func ClearDeviceQuarantine(c *gin.Context) {
+	udid := c.Param("udid")
+
+	err := device.ClearQuarantine(udid)
+	if err != nil {
+		JSONError(c.Writer, "device_quarantine", err.Error(), registrationErrorCode(err))
+		return
+	}
+
+	SimpleJSONResponse(c.Writer, "Successfully cleared quarantine of device with udid: "+udid, 200)
+}
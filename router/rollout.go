@@ -0,0 +1,68 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/device"
+)
+
+// Start a rolling update of the container image for the devices of an OS
+func StartImageRollout(c *gin.Context) {
+	var request device.RolloutRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil {
+		JSONError(c.Writer, "image_rollout", "Could not decode request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rollout, err := device.StartRollout(c.Param("os"), request)
+	if err != nil {
+		JSONError(c.Writer, "image_rollout", err.Error(), rolloutErrorCode(err))
+		return
+	}
+
+	c.JSON(http.StatusAccepted, rollout)
+}
+
+// Get the progress of the last image rollout of each OS
+func GetImageRollouts(c *gin.Context) {
+	c.JSON(200, device.GetRollouts())
+}
+
+// Get the progress of the last image rollout of an OS
+func GetImageRollout(c *gin.Context) {
+	rollout, err := device.GetRollout(c.Param("os"))
+	if err != nil {
+		JSONError(c.Writer, "image_rollout", err.Error(), rolloutErrorCode(err))
+		return
+	}
+
+	c.JSON(200, rollout)
+}
+
+// Restore the previous image of an OS and recreate the containers that already use the new one
+func RollbackImageRollout(c *gin.Context) {
+	rollout, err := device.RollbackRollout(c.Param("os"))
+	if err != nil {
+		JSONError(c.Writer, "image_rollout", err.Error(), rolloutErrorCode(err))
+		return
+	}
+
+	c.JSON(200, rollout)
+}
+
+// Map image rollout errors to response codes
+func rolloutErrorCode(err error) int {
+	switch {
+	case errors.Is(err, device.ErrInvalidRollout):
+		return http.StatusBadRequest
+	case errors.Is(err, device.ErrRolloutInProgress), errors.Is(err, device.ErrRolloutRolledBack):
+		return http.StatusConflict
+	case errors.Is(err, device.ErrRolloutNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -2,14 +2,14 @@ package router
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os/exec"
+	"strconv"
+	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	"github.com/gin-gonic/gin"
 	"github.com/shamanec/GADS-devices-provider/device"
 	"github.com/shamanec/GADS-devices-provider/util"
@@ -48,8 +48,12 @@ func SimpleJSONResponse(w http.ResponseWriter, responseMessage string, code int)
 	json.NewEncoder(w).Encode(message)
 }
 
+// Get the registered devices and the discovered but unregistered devices
 func GetProviderDevices(c *gin.Context) {
-	responseData, err := util.ConvertToJSONString(device.GetConfigDevices())
+	var devices []*device.Device
+	devices = append(devices, device.GetConfigDevices()...)
+	devices = append(devices, device.GetDiscoveredDevices()...)
+	responseData, err := util.ConvertToJSONString(devices)
 	if err != nil {
 		JSONError(c.Writer, "get_available_devices", "Could not get available devices", 500)
 		return
@@ -57,56 +61,122 @@ func GetProviderDevices(c *gin.Context) {
 	fmt.Fprintf(c.Writer, responseData)
 }
 
-func GetContainerLogs(c *gin.Context) {
-	containerID := c.Param("containerID")
+func CreateUdevRules(c *gin.Context) {
+	err := device.CreateUdevRules()
+	if err != nil {
+		JSONError(c.Writer, "create_udev_rules", "Could not create udev rules file", 500)
+		return
+	}
 
-	// Create the context and Docker client
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	SimpleJSONResponse(c.Writer, "Successfully created 90-device.rules file in project dir", 200)
+}
+
+func ReloadConfig(c *gin.Context) {
+	err := device.ReloadConfig()
 	if err != nil {
-		log.WithFields(log.Fields{
-			"event": "get_container_logs",
-		}).Error("Could not create docker client while attempting to get logs for container with ID: " + containerID + ". Error: " + err.Error())
-		JSONError(c.Writer, "get_container_logs", "Could not get logs for container with ID: "+containerID, 500)
+		if validationErr, ok := err.(*device.ConfigValidationError); ok {
+			c.JSON(400, configValidationResponse{
+				Valid:    false,
+				Problems: validationErr.Problems,
+			})
+			return
+		}
+		JSONError(c.Writer, "config_reload", "Could not reload config.json: "+err.Error(), 500)
 		return
 	}
 
-	// Create the options for the container logs function
-	options := types.ContainerLogsOptions{ShowStdout: true}
+	SimpleJSONResponse(c.Writer, "Successfully reloaded config.json", 200)
+}
+
+// Get the recorded state transitions of a device
+// Optional query params: `since` as unix timestamp in milliseconds or RFC3339 and `type` of event
+func GetDeviceEvents(c *gin.Context) {
+	filter := device.EventFilter{
+		UDID: c.Param("udid"),
+		Type: c.Query("type"),
+	}
+
+	if since := c.Query("since"); since != "" {
+		sinceMillis, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			sinceTime, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				JSONError(c.Writer, "get_device_events", "`since` should be a unix timestamp in milliseconds or RFC3339 time", http.StatusBadRequest)
+				return
+			}
+			sinceMillis = sinceTime.UnixMilli()
+		}
+		filter.Since = sinceMillis
+	}
 
-	// Get the container logs
-	out, err := cli.ContainerLogs(ctx, containerID, options)
+	events, err := device.GetDeviceEvents(filter)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"event": "get_container_logs",
-		}).Error("Could not get logs for container with ID: " + containerID + ". Error: " + err.Error())
-		JSONError(c.Writer, "get_container_logs", "Could not get logs for container with ID: "+containerID, 500)
+		JSONError(c.Writer, "get_device_events", "Could not get events for device "+filter.UDID+": "+err.Error(), 500)
 		return
 	}
 
-	// Get the ReadCloser of the logs into a buffer
-	// And convert it to string
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(out)
-	newStr := buf.String()
-
-	// If there are any logs - reply with them
-	// Or reply with a generic string
-	if newStr != "" {
-		SimpleJSONResponse(c.Writer, newStr, 200)
-	} else {
-		SimpleJSONResponse(c.Writer, "There are no existing logs for this container.", 200)
+	c.JSON(200, events)
+}
+
+// Remove the provider containers that do not belong to a registered connected device
+// With `dry_run=true` the containers are only listed
+func CollectOrphanContainers(c *gin.Context) {
+	result, err := device.CollectOrphanContainers(c.Query("dry_run") == "true")
+	if err != nil {
+		JSONError(c.Writer, "containers_gc", "Could not collect orphan containers: "+err.Error(), 500)
+		return
 	}
+
+	c.JSON(200, result)
 }
 
-func CreateUdevRules(c *gin.Context) {
-	err := device.CreateUdevRules()
+// Get the resource usage of a device container with its recent history
+func GetDeviceStats(c *gin.Context) {
+	udid := c.Param("udid")
+
+	stats, err := device.GetDeviceStats(udid)
 	if err != nil {
-		JSONError(c.Writer, "create_udev_rules", "Could not create udev rules file", 500)
+		code := http.StatusInternalServerError
+		if errors.Is(err, device.ErrDeviceNotFound) || errors.Is(err, device.ErrNoContainer) {
+			code = http.StatusNotFound
+		}
+		JSONError(c.Writer, "container_stats", "Could not get stats for device with udid: "+udid+": "+err.Error(), code)
 		return
 	}
 
-	SimpleJSONResponse(c.Writer, "Successfully created 90-device.rules file in project dir", 200)
+	c.JSON(200, stats)
+}
+
+// Get the resource usage of all device containers
+func GetContainersStats(c *gin.Context) {
+	c.JSON(200, device.GetContainersStats())
+}
+
+// Get the provider status including the device store connectivity
+func GetProviderStatus(c *gin.Context) {
+	c.JSON(200, device.GetProviderStatus())
+}
+
+type configValidationResponse struct {
+	Valid    bool                   `json:"valid"`
+	Problems []device.ConfigProblem `json:"problems"`
+}
+
+// Validate the config.json file on disk and list all the found problems
+func ValidateConfig(c *gin.Context) {
+	problems, err := device.ValidateConfigFile()
+	if err != nil {
+		JSONError(c.Writer, "config_validate", "Could not read config.json: "+err.Error(), 500)
+		return
+	}
+
+	if problems == nil {
+		problems = []device.ConfigProblem{}
+	}
+	c.JSON(200, configValidationResponse{
+		Valid:    len(problems) == 0,
+		Problems: problems,
+	})
 }
 
 func GetLogs(c *gin.Context) {